@@ -0,0 +1,316 @@
+package ginhttplogger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// flushRetryInterval is how often Flush checks whether there's room in a full queue for its marker
+const flushRetryInterval = 10 * time.Millisecond
+
+// AccessLogger is a handle on the log forwarding goroutine backing our middleware. It makes it
+// possible to flush pending logs, and to stop forwarding them gracefully when the server shuts down.
+type AccessLogger struct {
+	conf     AccessLoggerConfig
+	logQueue LogForwardingQueue
+	metrics  Metrics
+	done     chan struct{}
+	mutex    sync.RWMutex
+	closed   bool
+
+	// Logs that don't fit in the queue are handed to the spool writer goroutine through spoolQueue,
+	// spoolDone gets closed once it returned. replaying is closed once the forwarder is done with
+	// the last logs replayed from the spool.
+	spool      *diskSpool
+	spoolQueue chan Log
+	spoolDone  chan struct{}
+	replaying  chan struct{}
+}
+
+// UndeliveredLogsError is returned by Flush and Shutdown when the deadline expired before every
+// pending log could be forwarded
+type UndeliveredLogsError struct {
+	// Count is the number of logs still waiting in the queue, logs being forwarded at the time the
+	// deadline expired are not included
+	Count int
+	Err   error
+}
+
+func (e *UndeliveredLogsError) Error() string {
+	return fmt.Sprintf("%d access log(s) could not be delivered: %v", e.Count, e.Err)
+}
+
+func (e *UndeliveredLogsError) Unwrap() error {
+	return e.Err
+}
+
+func newAccessLogger(conf AccessLoggerConfig, logQueue LogForwardingQueue) *AccessLogger {
+	a := &AccessLogger{
+		conf:     conf,
+		logQueue: logQueue,
+		metrics:  pipelineMetrics(conf),
+		done:     make(chan struct{}),
+	}
+	if sampler, ok := a.metrics.(queueDepthSampler); ok {
+		sampler.sampleQueueDepth(func() int { return len(logQueue.intake()) })
+	}
+	return a
+}
+
+// start runs the log forwarding goroutine, done gets closed once the queue has been drained
+func (a *AccessLogger) start() {
+	go func() {
+		a.logQueue.run()
+		close(a.done)
+	}()
+
+	if a.spool != nil {
+		a.spoolQueue = make(chan Log, max(a.conf.DropSize, 1))
+		a.spoolDone = make(chan struct{})
+		go a.writeSpool()
+		go a.replaySpool()
+	}
+}
+
+// Middleware returns the gin.HandlerFunc logging requests through this AccessLogger
+func (a *AccessLogger) Middleware() gin.HandlerFunc {
+	return buildLoggingMiddleware(a.conf, a)
+}
+
+// enqueue passes a log to the forwarding goroutine, without ever blocking the request handler. It
+// returns false if the log had to be dropped.
+func (a *AccessLogger) enqueue(logEntry Log) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.closed {
+		log.Println("[WARNING][http-logging-middleware] Impossible to forward requests into log queue, logger shut down.")
+		a.metrics.Dropped()
+		return false
+	}
+
+	select {
+	case a.logQueue.intake() <- logEntry:
+		a.metrics.Enqueued()
+		a.metrics.QueueDepth(len(a.logQueue.intake()))
+		return true
+	default:
+		if a.spool == nil {
+			log.Println("[WARNING][http-logging-middleware] Impossible to forward requests into log queue, channel full.")
+			a.metrics.Dropped()
+			return false
+		}
+
+		// The queue is full, let's keep the log on disk until the forwarder catches up. Requests
+		// shouldn't wait for the disk though, the spool writer takes care of that.
+		select {
+		case a.spoolQueue <- logEntry:
+			return true
+		default:
+			log.Println("[WARNING][http-logging-middleware] Impossible to forward requests into log queue, channel full, spool queue full.")
+			a.metrics.Dropped()
+			return false
+		}
+	}
+}
+
+// writeSpool writes the logs that didn't fit in the queue to the spool, until shutdown
+func (a *AccessLogger) writeSpool() {
+	defer close(a.spoolDone)
+	for logEntry := range a.spoolQueue {
+		payload := buildPayload(&logEntry)
+		if err := a.spool.append(&payload); err != nil {
+			log.Println("[WARNING][http-logging-middleware] Impossible to forward requests into log queue, channel full, spooling failed:", err)
+			a.metrics.Dropped()
+		}
+	}
+}
+
+// replaySpool periodically moves logs from the spool to the forwarding queue, until shutdown
+func (a *AccessLogger) replaySpool() {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !a.replaySpoolBatch() {
+			return
+		}
+	}
+}
+
+// replaySpoolBatch feeds spooled logs to the forwarding queue as long as it's less than half full,
+// so that there's still room for fresh logs. Logs are only consumed from the spool once forwarded,
+// more of them are replayed once the forwarder is done with the previous batch. It returns false
+// once the logger has been shut down.
+func (a *AccessLogger) replaySpoolBatch() bool {
+	if a.replaying != nil {
+		select {
+		case <-a.replaying:
+			a.replaying = nil
+		default:
+			return !a.isClosed()
+		}
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.closed {
+		return false
+	}
+
+	intake := a.logQueue.intake()
+	room := cap(intake)/2 - len(intake)
+	if room <= 0 {
+		return true
+	}
+	logs, err := a.spool.read(room)
+	if err != nil {
+		log.Println("[ERROR][http-logging-middleware] Impossible to read spool:", err)
+		return true
+	}
+	if len(logs) == 0 {
+		return true
+	}
+
+	// The spool is checkpointed once the forwarder is done with every log of the batch
+	replaying := make(chan struct{})
+	pending := int32(1)
+	done := func() {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			if err := a.spool.checkpoint(); err != nil {
+				log.Println("[WARNING][http-logging-middleware] Impossible to checkpoint spool:", err)
+			}
+			close(replaying)
+		}
+	}
+
+replay:
+	for _, spooled := range logs {
+		spooled := spooled
+		logEntry := Log{startDate: spooled.payload.startDate, payload: spooled.payload, handled: func() {
+			a.spool.commit(spooled.seq, spooled.end)
+			done()
+		}}
+
+		atomic.AddInt32(&pending, 1)
+		select {
+		case intake <- logEntry:
+			a.metrics.Enqueued()
+		default:
+			// Fresh logs filled the queue in the meantime, the others will be replayed later
+			atomic.AddInt32(&pending, -1)
+			break replay
+		}
+	}
+	done()
+	a.metrics.QueueDepth(len(intake))
+	a.replaying = replaying
+	return true
+}
+
+// Flush blocks until every log queued before the call has been handled by the forwarder (batches
+// included), or until ctx expires
+func (a *AccessLogger) Flush(ctx context.Context) error {
+	// Logs are forwarded in order, once our marker has gone through the queue, every log that was
+	// there before it has been forwarded as well
+	marker := Log{flushed: make(chan struct{})}
+	ticker := time.NewTicker(flushRetryInterval)
+	defer ticker.Stop()
+	for !a.tryEnqueueMarker(marker) {
+		if a.isClosed() {
+			return a.wait(ctx)
+		}
+		// The queue is full: let's not hold the lock while waiting for room, Shutdown (and thus
+		// every request being logged) would be stuck behind us
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return &UndeliveredLogsError{Count: len(a.logQueue.intake()), Err: ctx.Err()}
+		}
+	}
+
+	select {
+	case <-marker.flushed:
+		return nil
+	case <-ctx.Done():
+		return &UndeliveredLogsError{Count: len(a.logQueue.intake()), Err: ctx.Err()}
+	}
+}
+
+// tryEnqueueMarker passes a flush marker to the forwarding goroutine if there's room for it in the
+// queue, it never blocks
+func (a *AccessLogger) tryEnqueueMarker(marker Log) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.closed {
+		return false
+	}
+	select {
+	case a.logQueue.intake() <- marker:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *AccessLogger) isClosed() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.closed
+}
+
+// Shutdown stops accepting new logs and waits until all the queued ones have been forwarded, or
+// until ctx expires. Requests logged after Shutdown was called are dropped.
+func (a *AccessLogger) Shutdown(ctx context.Context) error {
+	a.mutex.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.logQueue.intake())
+		if a.spoolQueue != nil {
+			close(a.spoolQueue)
+		}
+	}
+	a.mutex.Unlock()
+
+	err := a.wait(ctx)
+	if a.spool == nil {
+		return err
+	}
+	if err != nil {
+		// The forwarder may still hand logs to the spool through the dead letter callback, let's
+		// only close it once it returned
+		go func() {
+			<-a.done
+			<-a.spoolDone
+			if err := a.spool.close(); err != nil {
+				log.Println("[WARNING][http-logging-middleware] Impossible to close spool:", err)
+			}
+		}()
+		return err
+	}
+	return a.spool.close()
+}
+
+// wait blocks until the forwarding goroutine, and the spool writer if any, returned, or until ctx
+// expires
+func (a *AccessLogger) wait(ctx context.Context) error {
+	for _, done := range []chan struct{}{a.done, a.spoolDone} {
+		if done == nil {
+			continue
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return &UndeliveredLogsError{Count: len(a.logQueue.intake()), Err: ctx.Err()}
+		}
+	}
+	return nil
+}
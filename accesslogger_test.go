@@ -0,0 +1,179 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveRequests serves requests through an AccessLogger built from conf, then shuts it down so that
+// their logs have been forwarded. GET /users/:id answers "hello", POST /users a 400 and
+// DELETE /users/:id a 503.
+func serveRequests(t *testing.T, conf AccessLoggerConfig, requests ...*http.Request) {
+	accessLogger := NewAccessLogger(conf)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(accessLogger.Middleware())
+	router.GET("/users/:id", func(c *gin.Context) { c.String(200, "hello") })
+	router.POST("/users", func(c *gin.Context) { c.Status(400) })
+	router.DELETE("/users/:id", func(c *gin.Context) { c.Status(503) })
+	for _, r := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.NoError(t, accessLogger.Shutdown(context.Background()))
+}
+
+// testRequest builds a request sent by curl
+func testRequest(method, target string) *http.Request {
+	r, _ := http.NewRequest(method, target, nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	return r
+}
+
+// hostPort splits the address of a test server into the Host and Port settings
+func hostPort(address net.Addr) (string, int) {
+	host, port, _ := net.SplitHostPort(address.String())
+	portNumber, _ := strconv.Atoi(port)
+	return host, portNumber
+}
+
+// Test that Shutdown drains the queue and that logs are dropped afterwards
+func TestAccessLoggerShutdown(t *testing.T) {
+	var output bytes.Buffer
+	logrusLogger := logrus.New()
+	logrusLogger.Out = &output
+	logrusLogger.Formatter = &logrus.JSONFormatter{}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	accessLogger := NewAccessLogger(AccessLoggerConfig{LogrusLogger: logrusLogger})
+	router.Use(accessLogger.Middleware())
+	router.GET("/ping", func(c *gin.Context) {
+		c.Status(204)
+	})
+
+	for i := 0; i < 10; i++ {
+		r, _ := http.NewRequest("GET", "/ping", nil)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, accessLogger.Shutdown(ctx))
+	assert.Equal(t, 10, strings.Count(output.String(), "request processed"), "All queued logs should have been forwarded")
+
+	// Logging after shutdown must neither panic nor block
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NoError(t, accessLogger.Shutdown(ctx))
+}
+
+// Test that Flush sends incomplete batches right away, and reports logs it couldn't deliver
+func TestAccessLoggerFlush(t *testing.T) {
+	var received, available int32 = 0, 1
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			// Hijack the connection to make the forwarder fail
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		atomic.AddInt32(&received, 1)
+	}))
+	defer collector.Close()
+
+	host, port, _ := net.SplitHostPort(collector.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	accessLogger := NewAccessLogger(AccessLoggerConfig{
+		Host:          host,
+		Port:          portNumber,
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	router.Use(accessLogger.Middleware())
+	router.GET("/ping", func(c *gin.Context) {})
+
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, accessLogger.Flush(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received), "Incomplete batch should have been posted")
+
+	// Now let's make the collector unavailable, flushing shouldn't succeed anymore
+	atomic.StoreInt32(&available, 0)
+	for i := 0; i < 3; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	err := accessLogger.Flush(shortCtx)
+	assert.IsType(t, &UndeliveredLogsError{}, err)
+}
+
+// stalledLogForwardingQueue doesn't forward anything until it's released
+type stalledLogForwardingQueue struct {
+	Intake  chan Log
+	release chan struct{}
+}
+
+func (q *stalledLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *stalledLogForwardingQueue) run() {
+	<-q.release
+	for range q.Intake {
+	}
+}
+
+// Test that a Flush waiting for room in a full queue doesn't keep Shutdown, and requests being
+// logged, waiting
+func TestAccessLoggerFlushFullQueue(t *testing.T) {
+	queue := &stalledLogForwardingQueue{Intake: make(chan Log, 1), release: make(chan struct{})}
+	accessLogger := newAccessLogger(AccessLoggerConfig{}, queue)
+	accessLogger.start()
+	accessLogger.enqueue(Log{})
+
+	flushed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		flushed <- accessLogger.Flush(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	logged := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		accessLogger.Shutdown(ctx)
+		accessLogger.enqueue(Log{})
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Shutdown and enqueue should not wait for Flush")
+	}
+
+	close(queue.release)
+	assert.NoError(t, <-flushed)
+}
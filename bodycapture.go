@@ -0,0 +1,109 @@
+package ginhttplogger
+
+import "io"
+
+// bodyCapture keeps the first headSize and the last tailSize bytes of a body going through one of
+// our leeches, the tail being kept in a ring buffer, and counts the bytes it has seen
+type bodyCapture struct {
+	head     []byte
+	headSize int64
+
+	tail     []byte
+	tailSize int64
+	tailPos  int // oldest byte of the tail, once the ring buffer is full
+
+	total int64
+}
+
+func newBodyCapture(headSize, tailSize int64) bodyCapture {
+	headSize, tailSize = max64(headSize, 0), max64(tailSize, 0)
+	return bodyCapture{
+		head:     make([]byte, 0, min(headSize, leechPreallocSize)),
+		headSize: headSize,
+		tailSize: tailSize,
+	}
+}
+
+// capture stores what's left to fill in the head, and keeps the rest in the tail. It's generic
+// over strings so that WriteString() calls don't have to be converted.
+func capture[T []byte | string](c *bodyCapture, p T) {
+	c.total += int64(len(p))
+
+	if spaceLeft := c.headSize - int64(len(c.head)); spaceLeft > 0 {
+		n := min(spaceLeft, int64(len(p)))
+		c.head = append(c.head, p[:n]...)
+		p = p[n:]
+	}
+	if c.tailSize == 0 || len(p) == 0 {
+		return
+	}
+
+	// Larger than the tail ? Let's keep its end only
+	if int64(len(p)) >= c.tailSize {
+		c.tail = append(c.tail[:0], p[int64(len(p))-c.tailSize:]...)
+		c.tailPos = 0
+		return
+	}
+
+	if free := c.tailSize - int64(len(c.tail)); free > 0 {
+		n := min(free, int64(len(p)))
+		c.tail = append(c.tail, p[:n]...)
+		p = p[n:]
+	}
+	for len(p) > 0 {
+		n := copy(c.tail[c.tailPos:], p)
+		c.tailPos = (c.tailPos + n) % len(c.tail)
+		p = p[n:]
+	}
+}
+
+// readFrom implements io.ReaderFrom for our leeches, which io.Copy() uses when serving files and
+// readers. Bytes go through the leech's Write as long as we need them, the rest is handed to dst,
+// the original writer, through its ReadFrom when it has one (to keep sendfile and the like working).
+// direct is the number of bytes that went straight to dst.
+func (c *bodyCapture) readFrom(leech, dst io.Writer, r io.Reader) (n, direct int64, err error) {
+	if c.tailSize > 0 {
+		n, err = io.Copy(writerOnly{leech}, r)
+		return n, 0, err
+	}
+
+	if spaceLeft := c.headSize - int64(len(c.head)); spaceLeft > 0 {
+		n, err = io.CopyN(writerOnly{leech}, r, spaceLeft)
+		if err == io.EOF {
+			return n, 0, nil
+		} else if err != nil {
+			return n, 0, err
+		}
+	}
+
+	if readerFrom, ok := dst.(io.ReaderFrom); ok {
+		direct, err = readerFrom.ReadFrom(r)
+	} else {
+		direct, err = io.Copy(writerOnly{dst}, r)
+	}
+	c.total += direct
+	return n + direct, direct, err
+}
+
+// writerOnly hides the ReadFrom method of a writer so that io.Copy() doesn't call it back
+type writerOnly struct {
+	io.Writer
+}
+
+// tailBytes returns the tail of the body in order
+func (c *bodyCapture) tailBytes() []byte {
+	if c.tailPos == 0 {
+		return c.tail
+	}
+	ordered := make([]byte, 0, len(c.tail))
+	ordered = append(ordered, c.tail[c.tailPos:]...)
+	return append(ordered, c.tail[:c.tailPos]...)
+}
+
+// omitted returns how many bytes of the body are neither in the first headSize bytes of the head
+// nor in the tail. size is the size of the body when it's known, the body may not have been read
+// completely.
+func (c *bodyCapture) omitted(headSize, size int64) int64 {
+	logged := min(int64(len(c.head)), max64(headSize, 0)) + int64(len(c.tail))
+	return max64(max64(size, c.total)-logged, 0)
+}
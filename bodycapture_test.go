@@ -0,0 +1,44 @@
+package ginhttplogger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the head and the tail of bodies are kept whatever the size of the writes
+func TestBodyCapture(t *testing.T) {
+	body := "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	for _, writeSize := range []int{1, 3, 7, 20, len(body)} {
+		c := newBodyCapture(5, 8)
+		for i := 0; i < len(body); i += writeSize {
+			if i%2 == 0 {
+				capture(&c, body[i:min(int64(i+writeSize), int64(len(body)))])
+			} else {
+				capture(&c, []byte(body[i:min(int64(i+writeSize), int64(len(body)))]))
+			}
+		}
+		assert.Equal(t, "01234", string(c.head), "write size %d", writeSize)
+		assert.Equal(t, "stuvwxyz", string(c.tailBytes()), "write size %d", writeSize)
+		assert.Equal(t, int64(len(body)), c.total)
+		assert.Equal(t, int64(len(body)-13), c.omitted(5, -1))
+		assert.Equal(t, int64(len(body)-11), c.omitted(3, -1))
+		assert.Equal(t, int64(100-13), c.omitted(5, 100))
+	}
+
+	// Bodies fitting in the head and the tail aren't truncated
+	c := newBodyCapture(5, 8)
+	capture(&c, "0123456789")
+	assert.Equal(t, "01234", string(c.head))
+	assert.Equal(t, "56789", string(c.tailBytes()))
+	assert.Equal(t, int64(0), c.omitted(5, 10))
+
+	// No tail, only the head is kept
+	c = newBodyCapture(5, 0)
+	capture(&c, strings.Repeat("x", 100))
+	assert.Equal(t, 5, len(c.head))
+	assert.Empty(t, c.tailBytes())
+	assert.Equal(t, int64(95), c.omitted(5, -1))
+}
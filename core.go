@@ -0,0 +1,225 @@
+package ginhttplogger
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// loggingCore is the framework-agnostic part of our middlewares: it decides what to capture before
+// the handler runs, and builds the log entry once it returned. The gin and net/http middlewares
+// only plug their request context and response writer into it, so that they log the same records.
+type loggingCore struct {
+	conf       AccessLoggerConfig
+	logger     *AccessLogger
+	formatting *formattingOptions
+	rules      logRules
+	sampler    *sampler
+}
+
+func newLoggingCore(conf AccessLoggerConfig, logger *AccessLogger) *loggingCore {
+	return &loggingCore{
+		conf:       conf,
+		logger:     logger,
+		formatting: newFormattingOptions(conf),
+		rules:      compileLogRules(conf.Rules),
+		sampler:    newSampler(conf),
+	}
+}
+
+// exchange is a request being served, along with what we capture of it
+type exchange struct {
+	core       *loggingCore
+	candidates logRules
+
+	// When captureSize > 0, the request body is leeched and the middleware is expected to leech the
+	// response body with a writer of captureSize bytes, and to hand us its capture
+	captureSize      int64
+	requestBodyLeech *LeechedReadCloser
+	responseCapture  *bodyCapture
+
+	requestID string
+	trace     traceContext
+	startDate time.Time
+}
+
+// handledResponse is what the middlewares tell us about the response once the handler returned
+type handledResponse struct {
+	route    string
+	clientIP string
+	errors   string
+	status   int
+	size     int
+	header   http.Header
+}
+
+// begin is called before the handler runs, it returns nil when the request shouldn't be logged at
+// all. The request body is leeched and the request ID is set on the response headers.
+func (core *loggingCore) begin(r *http.Request, route string, responseHeader http.Header) *exchange {
+	conf := &core.conf
+	e := &exchange{core: core}
+
+	// Let's see which rules may apply to this request, once and for all
+	if len(core.rules) > 0 {
+		e.candidates = core.rules.forRequest(r, route)
+		if len(e.candidates) == 1 && e.candidates[0].statusClasses == nil && e.candidates[0].Skip {
+			return nil
+		}
+	}
+
+	if e.captureSize = e.candidates.captureSize(conf); e.captureSize > 0 {
+		// Let's use a Leech to pump a limited amount of bytes on the request
+		// body into RAM as this body is read
+		bodySize := min(r.ContentLength, e.captureSize)
+
+		// If the Content-Length header ain't set let's use a buffer of
+		// captureSize to log the request body.
+		if _, ok := NoBodyHTTPMethods[r.Method]; !ok && r.Header.Get("content-length") == "" {
+			bodySize = e.captureSize
+		}
+		e.requestBodyLeech = NewHeadTailLeechedReadCloser(r.Body, bodySize, conf.MaxBodyLogTailSize)
+		r.Body = e.requestBodyLeech
+	}
+
+	// Let's identify the request, handlers can get these IDs from their context to correlate their
+	// own logs with ours
+	if conf.RequestIDHeader != "" {
+		e.requestID = requestIDFromHeader(r.Header, conf.RequestIDHeader)
+		responseHeader.Set(conf.RequestIDHeader, e.requestID)
+	}
+	e.trace = parseTraceContext(r.Header)
+
+	// Start chrono
+	e.startDate = time.Now()
+
+	return e
+}
+
+// end builds the log entry once the handler returned, and hands it to the logger
+func (e *exchange) end(r *http.Request, res handledResponse) {
+	latency := time.Since(e.startDate)
+	core, conf := e.core, &e.core.conf
+
+	rule := e.candidates.forStatus(res.status)
+	if rule != nil && rule.Skip {
+		return
+	}
+	bodyLogPolicy, maxBodyLogSize := rule.bodyPolicy(conf)
+
+	responseContentLength := max(res.size, 0)
+
+	if conf.REDMetrics != nil {
+		conf.REDMetrics.observe(res.route, r.Method, res.status, latency, max64(r.ContentLength, 0), int64(responseContentLength))
+	}
+
+	var sampledOut int64
+	if core.sampler != nil {
+		var keep bool
+		if keep, sampledOut = core.sampler.sample(res.route, res.status, latency, e.trace.traceID); !keep {
+			return
+		}
+	}
+
+	// However, the response's Header object will be dereferenced... we'll have
+	// to store them them apart since we want to read them from the formatting
+	// goroutine
+	responseHeaders := make(map[string][]string)
+	for name, value := range res.header {
+		responseHeaders[name] = value
+	}
+
+	// Shall we pass the body as well ? If so let's not dereference it !
+	var requestBody, responseBody, requestBodyTail, responseBodyTail string
+	var requestBodyOmitted, responseBodyOmitted int64
+	if e.requestBodyLeech != nil && e.responseCapture != nil && (bodyLogPolicy == LogAllBodies || bodyLogPolicy == LogBodiesOnErrors && res.status >= 400) {
+
+		// And keep all this as strings, we may have captured more than what this request's
+		// rule needs. Bodies of content types we're not interested in are left out.
+		if core.formatting.bodyContentTypeAllowed(requestContentType(r)) {
+			requestBody = string(truncate(e.requestBodyLeech.GetLog(), maxBodyLogSize))
+			requestBodyTail = string(e.requestBodyLeech.GetTail())
+			requestBodyOmitted = e.requestBodyLeech.omitted(maxBodyLogSize, r.ContentLength)
+		}
+		if core.formatting.bodyContentTypeAllowed(res.header.Get("Content-Type")) {
+			responseBody = string(truncate(e.responseCapture.head, maxBodyLogSize))
+			responseBodyTail = string(e.responseCapture.tailBytes())
+			responseBodyOmitted = e.responseCapture.omitted(maxBodyLogSize, int64(responseContentLength))
+		}
+	}
+
+	// Chunked request bodies don't have a Content-Length, let's count what we've read instead
+	requestContentLength := r.ContentLength
+	if requestContentLength < 0 && e.requestBodyLeech != nil && e.requestBodyLeech.total > 0 {
+		requestContentLength = e.requestBodyLeech.total
+	}
+
+	// Let's wrap all that into a channel-friendly struct
+	logEntry := Log{
+		request:               r,
+		route:                 res.route,
+		clientIP:              res.clientIP,
+		status:                res.status,
+		errors:                res.errors,
+		startDate:             e.startDate,
+		latency:               latency,
+		responseHeaders:       responseHeaders,
+		requestBody:           requestBody,
+		requestBodyTail:       requestBodyTail,
+		requestBodyOmitted:    requestBodyOmitted,
+		requestContentLength:  requestContentLength,
+		responseBody:          responseBody,
+		responseBodyTail:      responseBodyTail,
+		responseBodyOmitted:   responseBodyOmitted,
+		responseContentLength: int64(responseContentLength),
+		bodyLogSize:           maxBodyLogSize,
+		formatting:            core.formatting,
+		requestID:             e.requestID,
+		trace:                 e.trace,
+		sampledOut:            sampledOut,
+	}
+
+	if !core.logger.enqueue(logEntry) && core.sampler != nil {
+		// This request, and the ones sampled out before it, would go unaccounted for: let's report
+		// them with the next log of the route
+		core.sampler.restore(res.route, sampledOut+1)
+	}
+}
+
+// requestContentType returns the mime type of the request body, the same way gin.Context's
+// ContentType() does
+func requestContentType(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if i := strings.IndexAny(contentType, " ;"); i >= 0 {
+		return contentType[:i]
+	}
+	return contentType
+}
+
+// clientIP returns the address of the client the same way gin.Context's ClientIP() does with gin's
+// default settings: the first address of X-Forwarded-For, X-Real-IP, or the remote address
+func clientIP(r *http.Request) string {
+	for _, name := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		header := r.Header.Get(name)
+		if header == "" {
+			continue
+		}
+		items := strings.Split(header, ",")
+		valid := true
+		for _, item := range items {
+			if net.ParseIP(strings.TrimSpace(item)) == nil {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return strings.TrimSpace(items[0])
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	return ip
+}
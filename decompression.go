@@ -0,0 +1,59 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decompressBody decodes the captured beginning of a body sent with the given Content-Encoding.
+// Captured bodies may be truncated, what could be decoded before the end of the input is returned
+// anyway. The output is bounded to maxSize bytes, which is all it takes to defuse decompression bombs
+// since we never read further. consumed is the number of bytes of the (compressed) input that were
+// read to produce the output, decoders may read a little ahead though. ok is false when the encoding
+// isn't supported or nothing could be decoded, truncated is true when the decoded body didn't fit in
+// maxSize bytes.
+func decompressBody(body, contentEncoding string, maxSize int64) (decoded string, consumed int64, truncated, ok bool) {
+	if body == "" || maxSize <= 0 {
+		return "", 0, false, false
+	}
+
+	input := strings.NewReader(body)
+	var reader io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(input)
+	case "deflate":
+		// deflate is supposed to be zlib-wrapped, some servers send raw deflate streams though
+		reader, err = zlib.NewReader(input)
+		if err != nil {
+			input.Reset(body)
+			reader, err = flate.NewReader(input), nil
+		}
+	case "br":
+		reader = brotli.NewReader(input)
+	default:
+		return "", 0, false, false
+	}
+	if err != nil {
+		return "", 0, false, false
+	}
+
+	// Let's read one more byte than needed to know whether we truncated the output
+	var out bytes.Buffer
+	_, err = io.Copy(&out, io.LimitReader(reader, maxSize+1))
+	if out.Len() == 0 && err != nil {
+		return "", 0, false, false
+	}
+	consumed = int64(len(body) - input.Len())
+	if int64(out.Len()) > maxSize {
+		return out.String()[:maxSize], consumed, true, true
+	}
+	return out.String(), consumed, err != nil, true
+}
@@ -0,0 +1,141 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// Test that captured bodies are decoded, even when truncated, and that the output is bounded
+func TestDecompressBody(t *testing.T) {
+	var body []byte
+	for i := 0; i < 200; i++ {
+		body = strconv.AppendQuote(append(body, `{"message": `...), strconv.Itoa(i*i*7919))
+		body = append(body, "}\n"...)
+	}
+
+	for encoding, contentEncoding := range map[string]string{
+		"gzip": "gzip", "deflate": "deflate", "raw-deflate": "deflate", "br": "br",
+	} {
+		compressed := string(compress(t, encoding, body))
+
+		decoded, consumed, truncated, ok := decompressBody(compressed, contentEncoding, 10000)
+		assert.True(t, ok, encoding)
+		assert.False(t, truncated, encoding)
+		assert.Equal(t, string(body), decoded, encoding)
+		assert.Equal(t, int64(len(compressed)), consumed, encoding)
+
+		decoded, _, truncated, ok = decompressBody(compressed, contentEncoding, 30)
+		assert.True(t, ok, encoding)
+		assert.True(t, truncated, encoding)
+		assert.Equal(t, string(body[:30]), decoded, encoding)
+
+		// The captured prefix of the compressed body is decoded as far as it goes
+		decoded, _, truncated, ok = decompressBody(compressed[:len(compressed)/2], contentEncoding, 10000)
+		assert.True(t, ok, encoding)
+		assert.True(t, truncated, encoding)
+		assert.True(t, strings.HasPrefix(string(body), decoded), encoding)
+	}
+
+	// 64MiB of zeroes only cost what we read of them
+	bomb := compress(t, "gzip", make([]byte, 64<<20))
+	decoded, consumed, truncated, ok := decompressBody(string(bomb), "gzip", 4096)
+	assert.True(t, ok)
+	assert.True(t, truncated)
+	assert.Equal(t, 4096, len(decoded))
+	assert.True(t, consumed < int64(len(bomb)))
+
+	// What wasn't decoded is reported in compressed bytes, the unit of the rest of the body
+	options := newFormattingOptions(AccessLoggerConfig{DecompressBodies: true})
+	content := options.httpContent(string(bomb[:len(bomb)/2]), string(bomb[len(bomb)/2:]), 100, "text/plain", "gzip", 4096)
+	assert.True(t, content.Truncated)
+	assert.Equal(t, "gzip", content.DecodedFrom)
+	assert.Equal(t, int64(len(bomb))+100-consumed, content.OmittedBytes)
+
+	_, _, _, ok = decompressBody("not compressed", "gzip", 4096)
+	assert.False(t, ok)
+	_, _, _, ok = decompressBody("not compressed", "zstd", 4096)
+	assert.False(t, ok)
+}
+
+// Test that compressed bodies are logged decompressed, while the client gets them untouched
+func TestMiddlewareDecompression(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:      LogAllBodies,
+		MaxBodyLogSize:     1000,
+		MaxBodyLogTailSize: 100,
+		DropSize:           10,
+		DecompressBodies:   true,
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	var handlerBody []byte
+	responseBody := compress(t, "br", []byte(`{"error": "boom"}`))
+	router.POST("/echo", func(c *gin.Context) {
+		handlerBody, _ = c.GetRawData()
+		c.Header("Content-Encoding", "br")
+		c.Data(500, "application/json", responseBody)
+	})
+
+	requestBody := compress(t, "gzip", []byte(`{"password": "hunter2", "name": "bob"}`))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/echo", bytes.NewReader(requestBody))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, requestBody, handlerBody)
+	assert.Equal(t, responseBody, w.Body.Bytes())
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, HTTPContent{
+		Size:        int64(len(requestBody)),
+		MimeType:    "application/json",
+		DecodedFrom: "gzip",
+		Encoding:    BodyEncodingText,
+		Content:     `{"password":"[REDACTED]","name":"bob"}`,
+	}, payload.Request.Content)
+	assert.Equal(t, HTTPContent{
+		Size:        int64(len(responseBody)),
+		MimeType:    "application/json",
+		DecodedFrom: "br",
+		Encoding:    BodyEncodingText,
+		Content:     `{"error": "boom"}`,
+	}, payload.Response.Content)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -27,7 +33,8 @@ func main() {
 		DropSize:       5,
 		RetryInterval:  5,
 	}
-	r.Use(httpLogger.New(alc))
+	accessLogger := httpLogger.NewAccessLogger(alc)
+	r.Use(accessLogger.Middleware())
 	r.Use(gin.Recovery())
 
 	// Route configuration
@@ -80,7 +87,24 @@ func main() {
 		c.JSON(409, gin.H{"hell": "o"})
 	})
 
-	if err := r.Run(":6060"); err != nil {
-		log.Errorf("Error running webserver: %v", err)
+	server := &http.Server{Addr: ":6060", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error running webserver: %v", err)
+		}
+	}()
+
+	// On SIGTERM, let's stop serving requests and flush the remaining access logs
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down webserver: %v", err)
+	}
+	if err := accessLogger.Shutdown(ctx); err != nil {
+		log.Errorf("Error flushing access logs: %v", err)
 	}
 }
@@ -0,0 +1,166 @@
+package ginhttplogger
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// BinaryBodiesBase64 logs binary bodies encoded in base64
+	BinaryBodiesBase64 = 1 + iota
+	// BinaryBodiesHash only logs the SHA-256 of the captured bytes of binary bodies
+	BinaryBodiesHash
+)
+
+// Encodings of the bodies, as logged in HTTPContent.Encoding
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+	BodyEncodingSHA256 = "sha256"
+)
+
+// textualMimeTypes are the non text/* types whose bodies are logged as text
+var textualMimeTypes = map[string]struct{}{
+	"application/json":                  {},
+	"application/x-ndjson":              {},
+	"application/xml":                   {},
+	"application/javascript":            {},
+	"application/x-www-form-urlencoded": {},
+	"application/yaml":                  {},
+	"application/x-yaml":                {},
+	"application/graphql":               {},
+}
+
+// mimeTypeOf strips the parameters of a content type
+func mimeTypeOf(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+func isTextualMimeType(mimeType string) bool {
+	if _, ok := textualMimeTypes[mimeType]; ok {
+		return true
+	}
+	return strings.HasPrefix(mimeType, "text/") || strings.HasSuffix(mimeType, "+json") || strings.HasSuffix(mimeType, "+xml")
+}
+
+// bodyContentTypeAllowed tells whether bodies of the given content type should be logged, according
+// to AccessLoggerConfig.BodyContentTypes. Patterns are mime types, possibly with a wildcard subtype
+// ("text/*").
+func (o *formattingOptions) bodyContentTypeAllowed(contentType string) bool {
+	if len(o.bodyContentTypes) == 0 {
+		return true
+	}
+
+	mimeType := mimeTypeOf(contentType)
+	for _, pattern := range o.bodyContentTypes {
+		if pattern == mimeType || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpContent formats a captured body: compressed bodies are decoded when
+// AccessLoggerConfig.DecompressBodies is set, bodies are then encoded according to their content
+// type. omitted is the number of bytes of the body that weren't captured, maxSize the most we log.
+func (o *formattingOptions) httpContent(body, tail string, omitted int64, contentType, contentEncoding string, maxSize int64) HTTPContent {
+	truncated := omitted > 0
+	decodedFrom := ""
+	if o.decompressBodies && contentEncoding != "" {
+		if decoded, consumed, decodedTruncated, ok := decompressBody(body, contentEncoding, maxSize); ok {
+			// The tail of a compressed stream can't be decoded without what precedes it. Omitted
+			// bytes are still counted as they were sent: the size of the decoded remainder of the
+			// body can't be known.
+			omitted += int64(len(body)) - consumed + int64(len(tail))
+			body, decodedFrom = decoded, contentEncoding
+			tail = ""
+			truncated = omitted > 0 || decodedTruncated
+		}
+	}
+
+	content := o.encodeBody(body, tail, contentType, truncated)
+	content.DecodedFrom = decodedFrom
+	content.Truncated = truncated
+	content.OmittedBytes = omitted
+	return content
+}
+
+// encodeBody returns the content of a body, and of its tail, as they should be logged. Textual
+// bodies are redacted and logged as text, binary ones are encoded according to
+// AccessLoggerConfig.BinaryBodyEncoding. Truncated bodies may have been cut in the middle of a
+// character, partial characters are left out.
+//
+// Textual bodies that aren't valid UTF-8 have their invalid bytes replaced before being redacted,
+// they must not make it to the logs unredacted. Complete JSON bodies that can't be parsed, and thus
+// redacted, are only logged as a hash.
+func (o *formattingOptions) encodeBody(body, tail, contentType string, truncated bool) (content HTTPContent) {
+	if body == "" && tail == "" {
+		return
+	}
+
+	text, textTail := body, tail
+	if truncated {
+		text, textTail = trimPartialRunes(text, textTail)
+	}
+	valid := utf8.ValidString(text) && utf8.ValidString(textTail)
+
+	// Without a content type, only bodies that are valid UTF-8 are deemed textual
+	mimeType := mimeTypeOf(contentType)
+	if isTextualMimeType(mimeType) || mimeType == "" && valid {
+		if bodyMimeType(contentType) == "json" && !truncated && !json.Valid([]byte(text)) {
+			return hashBody(body, tail)
+		}
+		if !valid {
+			text, textTail = strings.ToValidUTF8(text, "\uFFFD"), strings.ToValidUTF8(textTail, "\uFFFD")
+		}
+		content.Encoding = BodyEncodingText
+		content.Content = o.bodyRedactor.redact(text, contentType)
+		content.Tail = o.bodyRedactor.redactTail(textTail, contentType)
+		return
+	}
+
+	if o.binaryBodyEncoding == BinaryBodiesHash {
+		return hashBody(body, tail)
+	}
+
+	content.Encoding = BodyEncodingBase64
+	content.Content = base64.StdEncoding.EncodeToString([]byte(body))
+	if tail != "" {
+		content.Tail = base64.StdEncoding.EncodeToString([]byte(tail))
+	}
+	return
+}
+
+// hashBody returns the SHA-256 of the captured bytes of a body
+func hashBody(body, tail string) (content HTTPContent) {
+	hash := sha256.New()
+	hash.Write([]byte(body))
+	hash.Write([]byte(tail))
+	content.Encoding = BodyEncodingSHA256
+	content.Content = hex.EncodeToString(hash.Sum(nil))
+	return content
+}
+
+// trimPartialRunes removes the incomplete character that may end the head of a truncated body and
+// the continuation bytes that may start its tail
+func trimPartialRunes(head, tail string) (string, string) {
+	for i := 1; i < utf8.UTFMax && i <= len(head); i++ {
+		if utf8.RuneStart(head[len(head)-i]) {
+			if !utf8.FullRuneInString(head[len(head)-i:]) {
+				head = head[:len(head)-i]
+			}
+			break
+		}
+	}
+	for i := 0; i < utf8.UTFMax-1 && len(tail) > 0 && !utf8.RuneStart(tail[0]); i++ {
+		tail = tail[1:]
+	}
+	return head, tail
+}
@@ -0,0 +1,90 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that bodies are logged as text, base64 or hashes depending on their content type
+func TestBodyEncoding(t *testing.T) {
+	options := newFormattingOptions(AccessLoggerConfig{BinaryBodyEncoding: BinaryBodiesBase64})
+	png := "\x89PNG\r\n\x1a\n\x00\x00"
+
+	for _, test := range []struct {
+		body, tail, contentType string
+		truncated               bool
+		expected                HTTPContent
+	}{
+		{"", "", "application/json", false, HTTPContent{}},
+		{`{"password":"x"}`, "", "application/json; charset=utf-8", false, HTTPContent{Encoding: "text", Content: `{"password":"[REDACTED]"}`}},
+		{"héllo", "", "text/plain", false, HTTPContent{Encoding: "text", Content: "héllo"}},
+		{"héllo", "", "", false, HTTPContent{Encoding: "text", Content: "héllo"}},
+		{png, "", "image/png", false, HTTPContent{Encoding: "base64", Content: "iVBORw0KGgoAAA=="}},
+		{png, "", "", false, HTTPContent{Encoding: "base64", Content: "iVBORw0KGgoAAA=="}},
+		// Invalid UTF-8 is replaced in textual types, which are still redacted
+		{"caf\xe9", "", "text/plain", false, HTTPContent{Encoding: "text", Content: "caf\uFFFD"}},
+		{"{\"password\": \"caf\xe9\", \"name\": \"bob\"}", "", "application/json", false, HTTPContent{Encoding: "text", Content: `{"password":"[REDACTED]","name":"bob"}`}},
+		{"password=caf\xe9&name=bob", "", "application/x-www-form-urlencoded", false, HTTPContent{Encoding: "text", Content: "password=%5BREDACTED%5D&name=bob"}},
+		// JSON bodies that can't be parsed, and thus redacted, are hashed
+		{"{\"password\": 1, \"name\": caf\xe9}", "", "application/json", false, HTTPContent{Encoding: "sha256", Content: "6a8988a213fa39ad3ea11b97af41fdfe5759cdccf8985fc7a690071876ddf0e4"}},
+		{`{"a": x, "password": "hunter2"}`, "", "application/json", false, HTTPContent{Encoding: "sha256", Content: "6432c04a0bec21513c20384a4ba1fec53f631f61ee94e363a3747e674367572b"}},
+		// Characters cut by the truncation are left out
+		{"caf\xc3", "\xa9 au lait", "text/plain", true, HTTPContent{Encoding: "text", Content: "caf", Tail: " au lait"}},
+		{"caf\xc3", "", "text/plain", false, HTTPContent{Encoding: "text", Content: "caf\uFFFD"}},
+		{png, png, "application/octet-stream", true, HTTPContent{Encoding: "base64", Content: "iVBORw0KGgoAAA==", Tail: "iVBORw0KGgoAAA=="}},
+	} {
+		assert.Equal(t, test.expected, options.encodeBody(test.body, test.tail, test.contentType, test.truncated), "%q", test.body)
+	}
+
+	options = newFormattingOptions(AccessLoggerConfig{BinaryBodyEncoding: BinaryBodiesHash})
+	assert.Equal(t, HTTPContent{Encoding: "sha256", Content: "3d5ccb0cef4d3fd8b2474faf2038fbbb654c5c4e992aef8df4a48e8a3372d362"},
+		options.encodeBody(png, "", "image/png", false))
+	assert.Equal(t, HTTPContent{Encoding: "text", Content: "ok"}, options.encodeBody("ok", "", "text/plain", false))
+}
+
+// Test that only the bodies of allowed content types are logged
+func TestBodyContentTypes(t *testing.T) {
+	options := newFormattingOptions(AccessLoggerConfig{BodyContentTypes: []string{"application/json", "Text/*"}})
+	assert.True(t, options.bodyContentTypeAllowed("application/json; charset=utf-8"))
+	assert.True(t, options.bodyContentTypeAllowed("text/html"))
+	assert.False(t, options.bodyContentTypeAllowed("image/png"))
+	assert.False(t, options.bodyContentTypeAllowed(""))
+	assert.True(t, newFormattingOptions(AccessLoggerConfig{}).bodyContentTypeAllowed("image/png"))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:    LogAllBodies,
+		MaxBodyLogSize:   100,
+		DropSize:         10,
+		BodyContentTypes: []string{"application/json"},
+		HeaderDenyList:   []string{"Content-Type"},
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	router.POST("/avatar", func(c *gin.Context) {
+		c.GetRawData()
+		c.JSON(201, gin.H{"id": 1})
+	})
+
+	r, _ := http.NewRequest("POST", "/avatar", bytes.NewReader([]byte("\x89PNG\r\n")))
+	r.Header.Set("Content-Type", "image/png")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, HTTPContent{Size: 6, MimeType: "image/png"}, payload.Request.Content)
+	assert.Equal(t, BodyEncodingText, payload.Response.Content.Encoding)
+	assert.Equal(t, `{"id":1}`, payload.Response.Content.Content)
+	// Content types are logged even when headers aren't
+	assert.Equal(t, "application/json; charset=utf-8", payload.Response.Content.MimeType)
+	assert.NotContains(t, payload.Response.Headers, "content_type")
+}
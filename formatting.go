@@ -0,0 +1,233 @@
+package ginhttplogger
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// HeaderRedactMask replaces the header value with [REDACTED]
+	HeaderRedactMask = 1 + iota
+	// HeaderRedactDrop removes the header from logs altogether
+	HeaderRedactDrop
+	// HeaderRedactHash replaces the header value with its HMAC-SHA256, keyed with
+	// AccessLoggerConfig.HeaderHashKey, so that equal values can still be correlated
+	HeaderRedactHash
+	// HeaderRedactKeepPrefix only keeps the first AccessLoggerConfig.HeaderKeepPrefixLength
+	// characters of the header value
+	HeaderRedactKeepPrefix
+)
+
+// DefaultRedactedHeaders lists the headers redacted when AccessLoggerConfig.RedactedHeaders isn't
+// set
+var DefaultRedactedHeaders = map[string]int{
+	"Authorization":       HeaderRedactMask,
+	"Proxy-Authorization": HeaderRedactMask,
+	"Cookie":              HeaderRedactMask,
+	"Set-Cookie":          HeaderRedactMask,
+	"X-Api-Key":           HeaderRedactMask,
+	"X-Auth-Token":        HeaderRedactMask,
+	"X-Csrf-Token":        HeaderRedactMask,
+	"X-Xsrf-Token":        HeaderRedactMask,
+}
+
+const (
+	// DurationMicroseconds logs durations in microseconds
+	DurationMicroseconds = 1 + iota
+	// DurationMilliseconds logs durations in milliseconds
+	DurationMilliseconds
+	// DurationNanoseconds logs durations in nanoseconds
+	DurationNanoseconds
+)
+
+const (
+	// EpochMillis adds start and end times as milliseconds since the Unix epoch
+	EpochMillis = 1 + iota
+	// EpochNanos adds start and end times as nanoseconds since the Unix epoch
+	EpochNanos
+)
+
+// durationUnits maps duration unit options to their size and the hint logged next to durations
+var durationUnits = map[int]struct {
+	size time.Duration
+	name string
+}{
+	DurationMicroseconds: {time.Microsecond, "us"},
+	DurationMilliseconds: {time.Millisecond, "ms"},
+	DurationNanoseconds:  {time.Nanosecond, "ns"},
+}
+
+// DefaultRedactedQueryParams lists the query parameters whose values are masked when
+// AccessLoggerConfig.RedactedQueryParams isn't set
+var DefaultRedactedQueryParams = []string{
+	"access_token",
+	"api_key",
+	"apikey",
+	"auth",
+	"client_secret",
+	"code",
+	"password",
+	"secret",
+	"signature",
+	"token",
+}
+
+// redactedValue replaces the values we don't want to see in our logs
+const redactedValue = "[REDACTED]"
+
+// formattingOptions is built once from the configuration, and used by the forwarding goroutine
+// when turning a Log into an AccessLog
+type formattingOptions struct {
+	timeFormat   string
+	timeLocation *time.Location
+	epoch        int
+	durationUnit time.Duration
+	durationName string
+
+	redactedQueryParams map[string]struct{}
+
+	allowedHeaders         map[string]struct{}
+	deniedHeaders          map[string]struct{}
+	redactedHeaders        map[string]int
+	headerHashKey          []byte
+	headerKeepPrefixLength int
+
+	bodyRedactor bodyRedactor
+
+	binaryBodyEncoding int
+	bodyContentTypes   []string
+	decompressBodies   bool
+}
+
+func newFormattingOptions(conf AccessLoggerConfig) *formattingOptions {
+	options := &formattingOptions{
+		timeFormat:             conf.TimeFormat,
+		timeLocation:           conf.TimeLocation,
+		epoch:                  conf.EpochTimestamps,
+		redactedQueryParams:    make(map[string]struct{}),
+		deniedHeaders:          make(map[string]struct{}),
+		redactedHeaders:        make(map[string]int),
+		headerHashKey:          conf.HeaderHashKey,
+		headerKeepPrefixLength: conf.HeaderKeepPrefixLength,
+		binaryBodyEncoding:     conf.BinaryBodyEncoding,
+		decompressBodies:       conf.DecompressBodies,
+	}
+
+	if options.timeFormat == "" {
+		options.timeFormat = time.RFC3339Nano
+	}
+	unit, ok := durationUnits[conf.DurationUnit]
+	if !ok {
+		unit = durationUnits[DurationMicroseconds]
+	}
+	options.durationUnit, options.durationName = unit.size, unit.name
+
+	redactedQueryParams := conf.RedactedQueryParams
+	if redactedQueryParams == nil {
+		redactedQueryParams = DefaultRedactedQueryParams
+	}
+	for _, name := range redactedQueryParams {
+		options.redactedQueryParams[strings.ToLower(name)] = struct{}{}
+	}
+
+	if len(conf.HeaderAllowList) > 0 {
+		options.allowedHeaders = make(map[string]struct{})
+		for _, name := range conf.HeaderAllowList {
+			options.allowedHeaders[http.CanonicalHeaderKey(name)] = struct{}{}
+		}
+	}
+	for _, name := range conf.HeaderDenyList {
+		options.deniedHeaders[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+
+	redactedHeaders := conf.RedactedHeaders
+	if redactedHeaders == nil {
+		redactedHeaders = DefaultRedactedHeaders
+	}
+	for name, mode := range redactedHeaders {
+		options.redactedHeaders[http.CanonicalHeaderKey(name)] = mode
+	}
+
+	redactedBodyFields := conf.RedactedBodyFields
+	if redactedBodyFields == nil {
+		redactedBodyFields = DefaultRedactedBodyFields
+	}
+	options.bodyRedactor = newBodyRedactor(redactedBodyFields)
+
+	for _, contentType := range conf.BodyContentTypes {
+		options.bodyContentTypes = append(options.bodyContentTypes, mimeTypeOf(contentType))
+	}
+
+	// Without a key, hashes can only be correlated within the lifetime of the process
+	if len(options.headerHashKey) == 0 {
+		options.headerHashKey = make([]byte, 32)
+		rand.Read(options.headerHashKey)
+	}
+
+	return options
+}
+
+// formatTime formats a timestamp with the configured layout, in the configured time zone (or the
+// one of the timestamp, which is local time for timestamps taken by the middleware)
+func (o *formattingOptions) formatTime(t time.Time) string {
+	if o.timeLocation != nil {
+		t = t.In(o.timeLocation)
+	}
+	return t.Format(o.timeFormat)
+}
+
+// epochTimes returns t since the Unix epoch, in milliseconds and nanoseconds, only the configured
+// one being set
+func (o *formattingOptions) epochTimes(t time.Time) (millis int64, nanos int64) {
+	switch o.epoch {
+	case EpochMillis:
+		return t.UnixNano() / int64(time.Millisecond), 0
+	case EpochNanos:
+		return 0, t.UnixNano()
+	}
+	return 0, 0
+}
+
+// redactHeader applies the header policies to a (flattened) header value, it returns false if the
+// header shouldn't be logged at all
+func (o *formattingOptions) redactHeader(name, value string) (string, bool) {
+	name = http.CanonicalHeaderKey(name)
+
+	if o.allowedHeaders != nil {
+		if _, ok := o.allowedHeaders[name]; !ok {
+			return "", false
+		}
+	}
+	if _, ok := o.deniedHeaders[name]; ok {
+		return "", false
+	}
+
+	switch o.redactedHeaders[name] {
+	case HeaderRedactMask:
+		return redactedValue, true
+	case HeaderRedactDrop:
+		return "", false
+	case HeaderRedactHash:
+		mac := hmac.New(sha256.New, o.headerHashKey)
+		mac.Write([]byte(value))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)), true
+	case HeaderRedactKeepPrefix:
+		// Short values would be logged in full, let's mask them entirely
+		if len(value) <= o.headerKeepPrefixLength {
+			return redactedValue, true
+		}
+		// Let's not cut a multi-byte character in half
+		prefixLength := o.headerKeepPrefixLength
+		for prefixLength > 0 && !utf8.RuneStart(value[prefixLength]) {
+			prefixLength--
+		}
+		return value[:prefixLength] + redactedValue, true
+	}
+	return value, true
+}
@@ -0,0 +1,143 @@
+package ginhttplogger
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that header policies are applied when normalizing headers
+func TestHeaderRedaction(t *testing.T) {
+	headers := http.Header{
+		"Authorization":   {"Bearer abcdef"},
+		"Cookie":          {"session=1234"},
+		"X-Request-Id":    {"42"},
+		"X-Session-Id":    {"1234"},
+		"X-Forwarded-For": {"10.0.0.1", "10.0.0.2"},
+		"X-Internal":      {"yes"},
+	}
+
+	// Secure defaults
+	normalized, size := normalizeHeaderMap(headers, newFormattingOptions(AccessLoggerConfig{}))
+	assert.Equal(t, "[REDACTED]", normalized["authorization"])
+	assert.Equal(t, "[REDACTED]", normalized["cookie"])
+	assert.Equal(t, "10.0.0.1, 10.0.0.2", normalized["x_forwarded_for"])
+	assert.Equal(t, 118, size, "Header size should be computed on original headers")
+
+	// Custom policies
+	formatting := newFormattingOptions(AccessLoggerConfig{
+		HeaderDenyList: []string{"x-internal"},
+		RedactedHeaders: map[string]int{
+			"authorization": HeaderRedactKeepPrefix,
+			"Cookie":        HeaderRedactDrop,
+			"X-Session-Id":  HeaderRedactHash,
+		},
+		HeaderHashKey:          []byte("key"),
+		HeaderKeepPrefixLength: 7,
+	})
+	normalized, _ = normalizeHeaderMap(headers, formatting)
+	assert.Equal(t, map[string]string{
+		"authorization":   "Bearer [REDACTED]",
+		"x_request_id":    "42",
+		"x_session_id":    "hmac-sha256:280ed91eee6eb96a2b1cf598843c1308e84623d14e4208d96c20f7e2de81315e",
+		"x_forwarded_for": "10.0.0.1, 10.0.0.2",
+	}, normalized)
+
+	// Prefixes don't end in the middle of a character
+	formatting = newFormattingOptions(AccessLoggerConfig{
+		RedactedHeaders:        map[string]int{"X-Name": HeaderRedactKeepPrefix},
+		HeaderKeepPrefixLength: 3,
+	})
+	normalized, _ = normalizeHeaderMap(http.Header{"X-Name": {"Zoë Smith"}}, formatting)
+	assert.Equal(t, "Zo[REDACTED]", normalized["x_name"])
+
+	// Allow list
+	normalized, _ = normalizeHeaderMap(headers, newFormattingOptions(AccessLoggerConfig{
+		HeaderAllowList: []string{"X-Request-ID", "Authorization"},
+	}))
+	assert.Equal(t, map[string]string{"authorization": "[REDACTED]", "x_request_id": "42"}, normalized)
+}
+
+// Test that sensitive fields are masked in JSON and form bodies, truncated ones included
+func TestBodyRedaction(t *testing.T) {
+	redactor := newBodyRedactor([]string{"password", "card.number", "/tokens", "items.*.secret"})
+
+	for body, expected := range map[string]string{
+		// Nothing to redact, the body is left as it is
+		`{ "user": "bob" }`: `{ "user": "bob" }`,
+		`{"user": {"name": "bob", "Password": "hunter2"}, "card": {"number": 4242, "exp": "12/30"}}`: `{"user":{"name":"bob","Password":"[REDACTED]"},"card":{"number":"[REDACTED]","exp":"12/30"}}`,
+		`{"tokens": ["a", "b"], "items": [{"secret": {"x": 1}, "id": 1}, {"id": 2}]}`:                `{"tokens":"[REDACTED]","items":[{"secret":"[REDACTED]","id":1},{"id":2}]}`,
+		`[{"password": "x"}, 42, null]`: `[{"password":"[REDACTED]"},42,null]`,
+		// Truncated bodies
+		`{"name": "bob", "password": "hunt`:                        `{"name":"bob","password":"[REDACTED]"`,
+		`{"name": "bob", "password": "hunter2", "bio": "lorem ips`: `{"name":"bob","password":"[REDACTED]","bio"`,
+		`{"name": "bob", "password"`:                               `{"name":"bob","password":"[REDACTED]"`,
+	} {
+		assert.Equal(t, expected, redactor.redact(body, "application/json; charset=utf-8"))
+	}
+
+	assert.Equal(t, "user=bob&password=%5BREDACTED%5D&card[number]=%5BREDACTED%5D&x=1",
+		redactor.redact("user=bob&password=hunter2&card[number]=4242&x=1", "application/x-www-form-urlencoded"))
+	assert.Equal(t, "user=bob&password=%5BREDACTED%5D",
+		redactor.redact("user=bob&password=hun", "application/x-www-form-urlencoded"))
+	assert.Equal(t, "password=hunter2", redactor.redact("password=hunter2", "text/plain"))
+}
+
+// Test that sensitive fields are masked in body tails, whose paths are unknown
+func TestBodyTailRedaction(t *testing.T) {
+	redactor := newBodyRedactor([]string{"password", "card.number", "items.*.secret"})
+
+	for tail, expected := range map[string]string{
+		// The leading fragment may be the end of a sensitive value
+		`ter2", "id": 1}`: `, "id": 1}`,
+		`ter2"}`:          ``,
+		`ob", "password": "hunter2", "card": {"number": 4242}, "secret": {"a": [1, "}"]}, "ok": true}`: `, "password": "[REDACTED]", "card": {"number": "[REDACTED]"}, "secret": "[REDACTED]", "ok": true}`,
+		`, "error": "boom", "Password": "hunt`:                                                         `, "error": "boom", "Password": "[REDACTED]"`,
+	} {
+		assert.Equal(t, expected, redactor.redactTail(tail, "application/json"))
+	}
+
+	assert.Equal(t, "&password=%5BREDACTED%5D&x=1",
+		redactor.redactTail("rd=hunter2&password=hunter2&x=1", "application/x-www-form-urlencoded"))
+	assert.Equal(t, "ter2 at line 12", redactor.redactTail("ter2 at line 12", "text/plain"))
+	assert.Equal(t, "ter2", newBodyRedactor(nil).redactTail("ter2", "application/json"))
+}
+
+// Test that timestamps and durations are formatted as configured
+func TestTimeFormatting(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.NoError(t, err)
+	logEntry := Log{
+		request:   r,
+		startDate: time.Date(2017, 7, 14, 10, 0, 0, 123456789, time.UTC),
+		latency:   1500 * time.Microsecond,
+	}
+
+	// Defaults
+	logEntry.formatting = newFormattingOptions(AccessLoggerConfig{})
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, "2017-07-14T10:00:00.123456789Z", payload.TimeStarted)
+	assert.Equal(t, "2017-07-14T10:00:00.124956789Z", payload.TimeEnded)
+	assert.Equal(t, int64(1500), payload.Time)
+	assert.Equal(t, "us", payload.TimeUnit)
+	assert.Zero(t, payload.StartMillis)
+
+	// Custom layout, time zone and units
+	logEntry.formatting = newFormattingOptions(AccessLoggerConfig{
+		TimeFormat:      "2006-01-02 15:04:05.000 -0700",
+		TimeLocation:    paris,
+		EpochTimestamps: EpochMillis,
+		DurationUnit:    DurationMilliseconds,
+	})
+	payload = buildPayload(&logEntry)
+	assert.Equal(t, "2017-07-14 12:00:00.123 +0200", payload.TimeStarted)
+	assert.Equal(t, int64(1500026400123), payload.StartMillis)
+	assert.Equal(t, int64(1500026400124), payload.EndMillis)
+	assert.Zero(t, payload.StartNanos)
+	assert.Equal(t, int64(1), payload.Time)
+	assert.Equal(t, "ms", payload.TimeUnit)
+}
@@ -0,0 +1,200 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ElasticsearchLogForwardingQueue indexes logs in Elasticsearch or OpenSearch through the _bulk API
+type ElasticsearchLogForwardingQueue struct {
+	Intake        chan Log
+	retry         retryPolicy
+	batchSize     int
+	flushInterval time.Duration
+	index         string
+	username      string
+	password      string
+	apiKey        string
+	URL           string
+}
+
+// NewElasticsearchLogForwardingQueue builds a log forwarding queue that indexes entries in
+// Elasticsearch, by batches of BatchSize documents
+func NewElasticsearchLogForwardingQueue(conf AccessLoggerConfig) (q *ElasticsearchLogForwardingQueue) {
+	return &ElasticsearchLogForwardingQueue{
+		Intake:        make(chan Log, conf.DropSize),
+		retry:         newRetryPolicy(conf),
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+		index:         conf.ElasticsearchIndex,
+		username:      conf.ElasticsearchUsername,
+		password:      conf.ElasticsearchPassword,
+		apiKey:        conf.ElasticsearchAPIKey,
+		URL:           strings.TrimRight(backendURL(conf), "/") + "/_bulk",
+	}
+}
+
+func (q *ElasticsearchLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *ElasticsearchLogForwardingQueue) run() {
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+}
+
+// forward indexes a batch of logs. Documents rejected with a transient error (429, 5xx) are retried
+// on their own until they go through or the retry policy gives up on them, others are discarded
+// right away.
+func (q *ElasticsearchLogForwardingQueue) forward(batch []Log) {
+	pending := make([]AccessLog, 0, len(batch))
+	for i := range batch {
+		pending = append(pending, buildPayload(&batch[i]))
+	}
+
+	start := time.Now()
+	err := q.retry.run(func() error {
+		body, err := q.encode(pending)
+		if err != nil {
+			log.Println("[ERROR][elasticsearch-middleware] Failed to Marshal payload:", err)
+			q.retry.discard(pending, err)
+			pending = nil
+			return nil
+		}
+
+		retryable, rejected, err := q.post(body, len(pending))
+		if err != nil {
+			log.Printf("[WARNING][elasticsearch-middleware] Impossible to index %d request log(s): %v", len(pending), err)
+			return err
+		}
+
+		indexed := len(pending) - len(retryable) - len(rejected)
+		if indexed > 0 {
+			q.retry.metrics.Forwarded(indexed, len(body), time.Since(start))
+		}
+
+		var remaining []AccessLog
+		for _, item := range rejected {
+			q.retry.discard([]AccessLog{pending[item.position]}, item.err)
+		}
+		for _, item := range retryable {
+			remaining = append(remaining, pending[item.position])
+		}
+		pending = remaining
+
+		if len(pending) > 0 {
+			err = fmt.Errorf("%d document(s) rejected: %v", len(pending), retryable[0].err)
+			log.Printf("[WARNING][elasticsearch-middleware] Impossible to index %d request log(s): %v", len(pending), err)
+			return err
+		}
+		return nil
+	})
+	if err != nil && len(pending) > 0 {
+		q.retry.discard(pending, err)
+	}
+}
+
+// indexName formats the index pattern with the start date of a log, %Y, %m, %d and %H being
+// replaced with its year, month, day and hour (in UTC)
+func (q *ElasticsearchLogForwardingQueue) indexName(payload *AccessLog) string {
+	if !strings.Contains(q.index, "%") {
+		return q.index
+	}
+	date := payload.startDate.UTC()
+	return strings.NewReplacer(
+		"%Y", fmt.Sprintf("%04d", date.Year()),
+		"%m", fmt.Sprintf("%02d", date.Month()),
+		"%d", fmt.Sprintf("%02d", date.Day()),
+		"%H", fmt.Sprintf("%02d", date.Hour()),
+		"%%", "%",
+	).Replace(q.index)
+}
+
+// encode serializes a batch of logs as a _bulk request body: an index action followed by the
+// document, for each log
+func (q *ElasticsearchLogForwardingQueue) encode(payloads []AccessLog) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range payloads {
+		action := map[string]map[string]string{"index": {"_index": q.indexName(&payloads[i])}}
+		if err := encoder.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(payloads[i]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// bulkItemError is a document the bulk API didn't index
+type bulkItemError struct {
+	position int
+	err      error
+}
+
+// bulkResponse is the part of the _bulk API response we're interested in
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// post sends a _bulk request. Failed requests return an error and, unless it's permanent, should be
+// retried as a whole, otherwise the documents that weren't indexed are returned, split between those which may be
+// retried and those which won't ever make it
+func (q *ElasticsearchLogForwardingQueue) post(body []byte, count int) (retryable, rejected []bulkItemError, err error) {
+	req, err := http.NewRequest("POST", q.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if q.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+q.apiKey)
+	} else if q.username != "" {
+		req.SetBasicAuth(q.username, q.password)
+	}
+
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := backendResponseError(resp); err != nil {
+		return nil, nil, err
+	}
+
+	var bulk bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bulk); err != nil {
+		return nil, nil, fmt.Errorf("invalid bulk response: %v", err)
+	}
+	if !bulk.Errors {
+		return nil, nil, nil
+	}
+	if len(bulk.Items) != count {
+		return nil, nil, fmt.Errorf("bulk response has %d item(s) for %d document(s)", len(bulk.Items), count)
+	}
+
+	for position, item := range bulk.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				continue
+			}
+			itemErr := bulkItemError{position, errors.New(string(result.Error))}
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				retryable = append(retryable, itemErr)
+			} else {
+				rejected = append(rejected, itemErr)
+			}
+		}
+	}
+	return retryable, rejected, nil
+}
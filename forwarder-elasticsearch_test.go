@@ -0,0 +1,144 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that logs are bulk-indexed in dated indices, and that only the documents rejected with a
+// transient error are retried
+func TestElasticsearchForwarder(t *testing.T) {
+	var mutex sync.Mutex
+	var bulks [][]string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "elastic", username)
+		assert.Equal(t, "changeme", password)
+
+		// Let's collect the paths of the documents, along with the indices they go to
+		var paths []string
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+			assert.True(t, scanner.Scan())
+			var document AccessLog
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &document))
+			assert.Regexp(t, `^gin-requests-\d{4}\.\d{2}\.\d{2}$`, action["index"]["_index"])
+			paths = append(paths, document.Request.Path)
+
+			// /throttled is rejected the first time, /invalid always
+			status := 201
+			mutex.Lock()
+			if document.Request.Path == "/throttled" && len(bulks) == 0 {
+				status = 429
+			} else if document.Request.Path == "/invalid" {
+				status = 400
+			}
+			mutex.Unlock()
+			items = append(items, fmt.Sprintf(`{"index": {"status": %d, "error": {"type": "status_%d"}}}`, status, status))
+		}
+
+		mutex.Lock()
+		bulks = append(bulks, paths)
+		mutex.Unlock()
+		fmt.Fprintf(w, `{"took": 3, "errors": true, "items": [%s]}`, strings.Join(items, ","))
+	}))
+	defer collector.Close()
+
+	deadLetters := make(chan []AccessLog, 10)
+	accessLogger := NewAccessLogger(AccessLoggerConfig{
+		Protocol:              ProtocolElasticsearch,
+		URL:                   collector.URL + "/",
+		ElasticsearchUsername: "elastic",
+		ElasticsearchPassword: "changeme",
+		BatchSize:             3,
+		RetryInterval:         time.Millisecond,
+		RetryMaxAttempts:      3,
+		DeadLetter: func(entries []AccessLog, err error) {
+			assert.Contains(t, err.Error(), "status_400")
+			deadLetters <- entries
+		},
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(accessLogger.Middleware())
+	router.GET("/:name", func(c *gin.Context) {})
+	for _, path := range []string{"/ok", "/throttled", "/invalid"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.NoError(t, accessLogger.Shutdown(context.Background()))
+
+	assert.Equal(t, [][]string{{"/ok", "/throttled", "/invalid"}, {"/throttled"}}, bulks)
+	entries := <-deadLetters
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "/invalid", entries[0].Request.Path)
+	assert.Len(t, deadLetters, 0)
+}
+
+// Test index names and API key authentication
+func TestElasticsearchForwarderOptions(t *testing.T) {
+	q := NewElasticsearchLogForwardingQueue(AccessLoggerConfig{URL: "https://es:9200", ElasticsearchIndex: "logs-%Y-%m-%d-%H-100%%"})
+	assert.Equal(t, "https://es:9200/_bulk", q.URL)
+	payload := AccessLog{startDate: time.Date(2017, 7, 14, 23, 30, 0, 0, time.FixedZone("", -2*3600))}
+	assert.Equal(t, "logs-2017-07-15-01-100%", q.indexName(&payload))
+	q.index = "logs"
+	assert.Equal(t, "logs", q.indexName(&payload))
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "ApiKey c2VjcmV0", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"errors": false, "items": [{"index": {"status": 201}}]}`))
+	}))
+	defer collector.Close()
+
+	q = NewElasticsearchLogForwardingQueue(AccessLoggerConfig{URL: collector.URL, ElasticsearchAPIKey: "c2VjcmV0"})
+	retryable, rejected, err := q.post([]byte("{}\n{}\n"), 1)
+	assert.NoError(t, err)
+	assert.Empty(t, retryable)
+	assert.Empty(t, rejected)
+}
+
+// Test that bulk requests Elasticsearch rejects as a whole aren't retried, unless it's throttling
+func TestElasticsearchForwarderRejections(t *testing.T) {
+	for status, expectedAttempts := range map[int]int32{400: 1, 401: 1, 413: 1, 429: 3, 503: 3} {
+		var attempts int32
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			http.Error(w, "bulk request rejected", status)
+		}))
+
+		deadLetters := make(chan []AccessLog, 1)
+		serveRequests(t, AccessLoggerConfig{
+			Protocol:         ProtocolElasticsearch,
+			URL:              collector.URL,
+			BatchSize:        2,
+			RetryInterval:    time.Millisecond,
+			RetryMaxAttempts: 3,
+			DeadLetter: func(entries []AccessLog, err error) {
+				deadLetters <- entries
+			},
+		}, testRequest("GET", "/users/1"), testRequest("POST", "/users"))
+		collector.Close()
+
+		assert.Len(t, <-deadLetters, 2)
+		assert.Equal(t, expectedAttempts, atomic.LoadInt32(&attempts), "status %d", status)
+	}
+}
@@ -0,0 +1,199 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// fluentdTimeout bounds connection, write and acknowledgement delays on the forward protocol
+const fluentdTimeout = 10 * time.Second
+
+// fluentdEvent is a single [time, record] pair, as defined by the forward protocol
+type fluentdEvent struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+// FluentdLogForwardingQueue forwards logs to a Fluentd (or fluent-bit) forward input, speaking the
+// msgpack-based Forward protocol (https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1)
+// over a persistent TCP connection
+type FluentdLogForwardingQueue struct {
+	Intake        chan Log
+	Address       string
+	tag           string
+	mode          int
+	requireAck    bool
+	batchSize     int
+	flushInterval time.Duration
+	streamSender
+
+	reader  *bufio.Reader
+	encoder msgpackEncoder
+}
+
+// NewFluentdLogForwardingQueue builds a log forwarding queue that sends entries to a Fluentd
+// forward input. The tag is taken from the configured Path, without its leading slash.
+func NewFluentdLogForwardingQueue(conf AccessLoggerConfig) (q *FluentdLogForwardingQueue) {
+	q = &FluentdLogForwardingQueue{
+		Intake:        make(chan Log, conf.DropSize),
+		Address:       net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)),
+		tag:           strings.TrimPrefix(conf.Path, "/"),
+		mode:          conf.FluentdMode,
+		requireAck:    conf.FluentdRequireAck,
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+	}
+	q.streamSender = newStreamSender("fluentd", "fluentd", fluentdTimeout, q.dial, conf)
+	return q
+}
+
+func (q *FluentdLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *FluentdLogForwardingQueue) run() {
+	// Forwards payloads asynchronously, by batches
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+	q.disconnect()
+}
+
+// forward sends a batch of logs to Fluentd
+func (q *FluentdLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	events := make([]fluentdEvent, 0, len(batch))
+	for i := range batch {
+		payload := buildPayload(&batch[i])
+		record, err := payloadToMap(payload)
+		if err != nil {
+			log.Println("[ERROR][fluentd-middleware] Failed to convert payload to a record:", err)
+			continue
+		}
+		payloads = append(payloads, payload)
+		events = append(events, fluentdEvent{time: batch[i].startDate, record: record})
+	}
+
+	deliver(&q.streamSender, payloads, events, q.send)
+}
+
+// send writes events on the wire in the configured mode and returns how many of them were delivered
+func (q *FluentdLogForwardingQueue) send(events []fluentdEvent) (sent int, err error) {
+	switch q.mode {
+	case FluentdModeMessage:
+		// One message per event: [tag, time, record, option]
+		for _, event := range events {
+			q.encoder.reset()
+			q.encoder.encodeArrayHeader(4)
+			q.encoder.encodeString(q.tag)
+			q.encoder.encodeEventTime(event.time)
+			if err = q.encoder.encode(event.record); err != nil {
+				return sent, err
+			}
+			if err = q.writeWithOption(1); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		return sent, nil
+
+	case FluentdModePackedForward:
+		// [tag, <msgpack stream of [time, record] entries>, option]
+		var entries msgpackEncoder
+		for _, event := range events {
+			entries.encodeArrayHeader(2)
+			entries.encodeEventTime(event.time)
+			if err = entries.encode(event.record); err != nil {
+				return 0, err
+			}
+		}
+		q.encoder.reset()
+		q.encoder.encodeArrayHeader(3)
+		q.encoder.encodeString(q.tag)
+		q.encoder.encodeBin(entries.bytes())
+
+	default:
+		// [tag, [[time, record], ...], option]
+		q.encoder.reset()
+		q.encoder.encodeArrayHeader(3)
+		q.encoder.encodeString(q.tag)
+		q.encoder.encodeArrayHeader(len(events))
+		for _, event := range events {
+			q.encoder.encodeArrayHeader(2)
+			q.encoder.encodeEventTime(event.time)
+			if err = q.encoder.encode(event.record); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err = q.writeWithOption(len(events)); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// writeWithOption appends the option map to the message being encoded, writes it and waits for
+// Fluentd's acknowledgement if we asked for one
+func (q *FluentdLogForwardingQueue) writeWithOption(size int) error {
+	option := map[string]interface{}{"size": size}
+
+	var chunk string
+	if q.requireAck {
+		chunkID := make([]byte, 16)
+		if _, err := rand.Read(chunkID); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(chunkID)
+		option["chunk"] = chunk
+	}
+	if err := q.encoder.encode(option); err != nil {
+		return err
+	}
+
+	if err := q.write(q.encoder.bytes()); err != nil {
+		return err
+	}
+
+	if !q.requireAck {
+		return nil
+	}
+
+	q.conn.SetReadDeadline(time.Now().Add(fluentdTimeout))
+	response, err := msgpackDecode(q.reader)
+	if err != nil {
+		return fmt.Errorf("failed to read ack: %v", err)
+	}
+	if ack, ok := response.(map[string]interface{}); !ok || ack["ack"] != chunk {
+		return fmt.Errorf("unexpected ack %v (chunk: %s)", response, chunk)
+	}
+	return nil
+}
+
+// dial connects to Fluentd, acknowledgements being read from the new connection
+func (q *FluentdLogForwardingQueue) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", q.Address, fluentdTimeout)
+	if err == nil {
+		q.reader = bufio.NewReader(conn)
+	}
+	return conn, err
+}
+
+// payloadToMap converts an AccessLog to a generic map, matching the JSON representation of our logs
+func payloadToMap(payload AccessLog) (record map[string]interface{}, err error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payloadBytes))
+	decoder.UseNumber()
+	err = decoder.Decode(&record)
+	return record, err
+}
@@ -0,0 +1,150 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that logs reach a fake Fluentd forward input, in every mode, and that acks are handled
+func TestFluentdForwarder(t *testing.T) {
+	for _, mode := range []int{FluentdModeMessage, FluentdModeForward, FluentdModePackedForward} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		// Our fake Fluentd decodes every message it receives and acknowledges it
+		records := make(chan map[string]interface{}, 10)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				message, err := msgpackDecode(reader)
+				if err != nil {
+					return
+				}
+				fields := message.([]interface{})
+				assert.Equal(t, "gin.requests", fields[0])
+
+				var entries []interface{}
+				switch mode {
+				case FluentdModeMessage:
+					entries = []interface{}{[]interface{}{fields[1], fields[2]}}
+				case FluentdModeForward:
+					entries = fields[1].([]interface{})
+				case FluentdModePackedForward:
+					stream := bufio.NewReader(bytes.NewReader(fields[1].([]byte)))
+					for {
+						entry, err := msgpackDecode(stream)
+						if err != nil {
+							break
+						}
+						entries = append(entries, entry)
+					}
+				}
+				for _, entry := range entries {
+					records <- entry.([]interface{})[1].(map[string]interface{})
+				}
+
+				var ack msgpackEncoder
+				ack.encode(map[string]interface{}{"ack": fields[len(fields)-1].(map[string]interface{})["chunk"]})
+				conn.Write(ack.bytes())
+			}
+		}()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		portNumber, _ := strconv.Atoi(port)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(New(AccessLoggerConfig{
+			Protocol:          ProtocolFluentdForward,
+			Host:              "127.0.0.1",
+			Port:              portNumber,
+			BatchSize:         2,
+			FlushInterval:     100 * time.Millisecond,
+			FluentdMode:       mode,
+			FluentdRequireAck: true,
+		}))
+		router.GET("/ping", func(c *gin.Context) {
+			c.Status(418)
+		})
+
+		for i := 0; i < 3; i++ {
+			r, _ := http.NewRequest("GET", "/ping", nil)
+			router.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		for i := 0; i < 3; i++ {
+			record := <-records
+			assert.Equal(t, "/ping", record["request"].(map[string]interface{})["path"])
+			assert.Equal(t, uint64(418), record["response"].(map[string]interface{})["status"])
+		}
+		listener.Close()
+	}
+}
+
+// Test that logs that couldn't be delivered aren't reported as forwarded
+func TestFluentdForwarderMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	portNumber, _ := strconv.Atoi(port)
+
+	metrics := NewExpvarMetrics("")
+	accessLogger := NewAccessLogger(AccessLoggerConfig{
+		Protocol:         ProtocolFluentdForward,
+		Host:             "127.0.0.1",
+		Port:             portNumber,
+		Metrics:          metrics,
+		RetryInterval:    time.Millisecond,
+		RetryMaxAttempts: 2,
+		DeadLetter:       func([]AccessLog, error) {},
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(accessLogger.Middleware())
+	router.GET("/ping", func(c *gin.Context) {})
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NoError(t, accessLogger.Shutdown(context.Background()))
+
+	assert.Equal(t, "0", metrics.Vars().Get("forwarded").String())
+	assert.Equal(t, "0", metrics.Vars().Get("forwarding_latency_count").String())
+	assert.Equal(t, "1", metrics.Vars().Get("failed").String())
+}
+
+// Test that the lengths announced by a broken peer are checked before anything gets allocated
+func TestMsgpackDecodeLengthLimits(t *testing.T) {
+	for _, message := range [][]byte{
+		{0xc6, 0xff, 0xff, 0xff, 0xff},
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa3, 'a', 'c', 'k', 0xc9, 0xff, 0xff, 0xff, 0xff, 0x00},
+	} {
+		_, err := msgpackDecode(bufio.NewReader(bytes.NewReader(message)))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds")
+	}
+
+	var encoder msgpackEncoder
+	encoder.encode(map[string]interface{}{"ack": "chunk"})
+	ack, err := msgpackDecode(bufio.NewReader(bytes.NewReader(encoder.bytes())))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"ack": "chunk"}, ack)
+}
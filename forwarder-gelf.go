@@ -0,0 +1,228 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// gelfTimeout bounds connection and write delays
+const gelfTimeout = 10 * time.Second
+
+// GELF chunks start with 2 magic bytes, an 8 bytes message ID, their sequence number and the
+// number of chunks, Graylog doesn't accept messages of more than 128 chunks
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+// GELFLogForwardingQueue sends logs to Graylog as GELF 1.1 messages, over UDP or TCP
+type GELFLogForwardingQueue struct {
+	Intake        chan Log
+	Address       string
+	transport     int
+	compression   int
+	chunkSize     int
+	host          string
+	batchSize     int
+	flushInterval time.Duration
+	streamSender
+}
+
+// NewGELFLogForwardingQueue builds a log forwarding queue that sends entries to the GELF input
+// listening on Host:Port
+func NewGELFLogForwardingQueue(conf AccessLoggerConfig) (q *GELFLogForwardingQueue) {
+	chunkSize := conf.GELFChunkSize
+	if chunkSize <= gelfChunkHeaderSize {
+		chunkSize = 1420
+	}
+	q = &GELFLogForwardingQueue{
+		Intake:        make(chan Log, conf.DropSize),
+		Address:       net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)),
+		transport:     conf.GELFTransport,
+		compression:   conf.GELFCompression,
+		chunkSize:     chunkSize,
+		host:          conf.GELFHost,
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+	}
+	q.streamSender = newStreamSender("gelf", "Graylog", gelfTimeout, q.dial, conf)
+	return q
+}
+
+func (q *GELFLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *GELFLogForwardingQueue) run() {
+	// Forwards payloads asynchronously, by batches
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+	q.disconnect()
+}
+
+// forward sends a batch of logs. Messages too large to be sent over UDP are discarded right away.
+func (q *GELFLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	messages := make([][][]byte, 0, len(batch))
+	for i := range batch {
+		payload := buildPayload(&batch[i])
+		message, err := q.message(&payload)
+		if err != nil {
+			log.Println("[ERROR][gelf-middleware] Failed to Marshal payload:", err)
+			q.retry.discard([]AccessLog{payload}, err)
+			continue
+		}
+		payloads = append(payloads, payload)
+		messages = append(messages, message)
+	}
+
+	deliver(&q.streamSender, payloads, messages, q.send)
+}
+
+// send writes messages on the wire and returns how many of them were sent. Each message is made of
+// one datagram, or of its chunks, over UDP, and of a single null-terminated frame over TCP.
+func (q *GELFLogForwardingQueue) send(messages [][][]byte) (sent int, err error) {
+	for _, message := range messages {
+		for _, frame := range message {
+			if err := q.write(frame); err != nil {
+				return sent, err
+			}
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (q *GELFLogForwardingQueue) dial() (net.Conn, error) {
+	if q.transport == GELFTransportTCP {
+		return net.DialTimeout("tcp", q.Address, gelfTimeout)
+	}
+	return net.DialTimeout("udp", q.Address, gelfTimeout)
+}
+
+// message formats a log as a GELF message, ready to be written on the wire
+func (q *GELFLogForwardingQueue) message(payload *AccessLog) ([][]byte, error) {
+	data, err := q.encode(payload)
+	if err != nil {
+		return nil, err
+	}
+	if q.transport == GELFTransportTCP {
+		return [][]byte{append(data, 0)}, nil
+	}
+
+	if data, err = q.compress(data); err != nil {
+		return nil, err
+	}
+	return gelfChunks(data, q.chunkSize)
+}
+
+// encode serializes a log as a GELF 1.1 message, its fields becoming additional fields
+func (q *GELFLogForwardingQueue) encode(payload *AccessLog) ([]byte, error) {
+	record, err := payloadToMap(*payload)
+	if err != nil {
+		return nil, err
+	}
+
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          q.host,
+		"short_message": fmt.Sprintf("%s %s %d", payload.Request.Method, payload.Request.Path, payload.Response.Status),
+		"timestamp":     float64(payload.startDate.UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         syslogSeverities[statusLevel(payload.Response.Status)],
+	}
+	gelfAdditionalFields(message, "", record)
+	return json.Marshal(message)
+}
+
+// gelfAdditionalFields flattens a log into GELF additional fields: nested fields are joined with
+// underscores and prefixed with one ("request": {"method": "GET"} becomes "_request_method": "GET").
+// GELF values are strings or numbers, other values are logged as strings.
+func gelfAdditionalFields(message map[string]interface{}, prefix string, record map[string]interface{}) {
+	for name, value := range record {
+		// Field names may only hold word characters, dots and dashes
+		name = prefix + "_" + strings.Map(func(r rune) rune {
+			if r == '.' || r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				return r
+			}
+			return '_'
+		}, name)
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			gelfAdditionalFields(message, name, v)
+		case string, json.Number:
+			message[name] = v
+		case nil:
+		default:
+			// Booleans and arrays
+			data, _ := json.Marshal(v)
+			message[name] = string(data)
+		}
+	}
+	// _id is reserved
+	delete(message, "_id")
+}
+
+// compress compresses a message sent over UDP, with the configured algorithm
+func (q *GELFLogForwardingQueue) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch q.compression {
+	case GELFCompressionGzip:
+		writer = gzip.NewWriter(&buf)
+	case GELFCompressionZlib:
+		writer = zlib.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gelfChunks splits a message into datagrams of at most chunkSize bytes, when it doesn't fit in
+// one
+func gelfChunks(data []byte, chunkSize int) ([][]byte, error) {
+	if len(data) <= chunkSize {
+		return [][]byte{data}, nil
+	}
+
+	dataSize := chunkSize - gelfChunkHeaderSize
+	count := (len(data) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("message too large to be sent over UDP: %d bytes, %d chunks", len(data), count)
+	}
+
+	messageID := make([]byte, 8)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := make([]byte, 0, chunkSize)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, messageID...)
+		chunk = append(chunk, byte(i), byte(count))
+		end := (i + 1) * dataSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk, data[i*dataSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,176 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiveGELFOverUDP reads datagrams until it gets count messages, reassembling chunked messages and
+// decompressing them
+func receiveGELFOverUDP(t *testing.T, conn net.PacketConn, count int) (messages []map[string]interface{}) {
+	chunks := make(map[string][][]byte)
+	buf := make([]byte, 65536)
+	for len(messages) < count {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+
+		if data[0] == 0x1e && data[1] == 0x0f {
+			id, seq, total := string(data[2:10]), int(data[10]), int(data[11])
+			if chunks[id] == nil {
+				chunks[id] = make([][]byte, total)
+			}
+			chunks[id][seq] = data[12:]
+			complete := true
+			for _, chunk := range chunks[id] {
+				complete = complete && chunk != nil
+			}
+			if !complete {
+				continue
+			}
+			data = bytes.Join(chunks[id], nil)
+		}
+
+		var reader io.Reader = bytes.NewReader(data)
+		switch {
+		case data[0] == 0x1f && data[1] == 0x8b:
+			reader, err = gzip.NewReader(reader)
+		case data[0] == 0x78:
+			reader, err = zlib.NewReader(reader)
+		}
+		assert.NoError(t, err)
+
+		var message map[string]interface{}
+		assert.NoError(t, json.NewDecoder(reader).Decode(&message))
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// Test that logs are sent as GELF 1.1 messages, with their fields as additional fields and a level
+// that follows the response status
+func TestGELFForwarderUDP(t *testing.T) {
+	for _, compression := range []int{GELFCompressionGzip, GELFCompressionZlib, GELFCompressionNone} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		host, port := hostPort(conn.LocalAddr())
+		serveRequests(t, AccessLoggerConfig{
+			Protocol:        ProtocolGELF,
+			Host:            host,
+			Port:            port,
+			BatchSize:       2,
+			GELFCompression: compression,
+			GELFHost:        "web-1",
+		}, testRequest("GET", "/users/1?page=2"), testRequest("DELETE", "/users/1"))
+
+		messages := receiveGELFOverUDP(t, conn, 2)
+		conn.Close()
+		if !assert.Len(t, messages, 2) {
+			continue
+		}
+
+		get := messages[0]
+		assert.Equal(t, "1.1", get["version"])
+		assert.Equal(t, "web-1", get["host"])
+		assert.Equal(t, "GET /users/1 200", get["short_message"])
+		assert.Equal(t, float64(6), get["level"])
+		assert.InDelta(t, float64(time.Now().Unix()), get["timestamp"], 10)
+		assert.Equal(t, "GET", get["_request_method"])
+		assert.Equal(t, "/users/:id", get["_request_route"])
+		assert.Equal(t, "2", get["_request_query_params_page"])
+		assert.Equal(t, "curl/8.0", get["_request_headers_user_agent"])
+		assert.Equal(t, float64(200), get["_response_status"])
+		assert.NotEmpty(t, get["_request_id"])
+		for name := range get {
+			assert.Regexp(t, `^(version|host|short_message|timestamp|level|_[\w\.\-]+)$`, name)
+		}
+
+		failed := messages[1]
+		assert.Equal(t, "DELETE /users/1 503", failed["short_message"])
+		assert.Equal(t, float64(3), failed["level"])
+	}
+}
+
+// Test that messages larger than a datagram are chunked, and that those which would need too many
+// chunks are refused
+func TestGELFForwarderChunking(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	host, port := hostPort(conn.LocalAddr())
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:        ProtocolGELF,
+		Host:            host,
+		Port:            port,
+		BatchSize:       2,
+		GELFCompression: GELFCompressionNone,
+		GELFChunkSize:   100,
+	}, testRequest("GET", "/users/1?page=2"), testRequest("DELETE", "/users/1"))
+
+	messages := receiveGELFOverUDP(t, conn, 2)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "GET /users/1 200", messages[0]["short_message"])
+		assert.Equal(t, "DELETE /users/1 503", messages[1]["short_message"])
+	}
+
+	chunks, err := gelfChunks(make([]byte, 129*88), 100)
+	assert.Nil(t, chunks)
+	assert.Error(t, err)
+	chunks, err = gelfChunks(make([]byte, 128*88), 100)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 128)
+}
+
+// Test that messages are null-terminated over TCP
+func TestGELFForwarderTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	frames := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			frame, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			frames <- strings.TrimSuffix(frame, "\x00")
+		}
+	}()
+
+	host, port := hostPort(listener.Addr())
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:      ProtocolGELF,
+		Host:          host,
+		Port:          port,
+		BatchSize:     2,
+		GELFTransport: GELFTransportTCP,
+	}, testRequest("GET", "/users/1?page=2"), testRequest("DELETE", "/users/1"))
+
+	for _, shortMessage := range []string{"GET /users/1 200", "DELETE /users/1 503"} {
+		var message map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(<-frames), &message))
+		assert.Equal(t, shortMessage, message["short_message"])
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"time"
 )
 
@@ -19,7 +18,10 @@ type LogForwardingQueue interface {
 // HTTPLogForwardingQueue forwards logs to an HTTP backend
 type HTTPLogForwardingQueue struct {
 	Intake        chan Log
-	retryInterval time.Duration
+	retry         retryPolicy
+	batchSize     int
+	flushInterval time.Duration
+	batchFormat   int
 	URL           string
 }
 
@@ -28,7 +30,10 @@ type HTTPLogForwardingQueue struct {
 func NewHTTPLogForwardingQueue(conf AccessLoggerConfig) (q *HTTPLogForwardingQueue) {
 	return &HTTPLogForwardingQueue{
 		Intake:        make(chan Log, conf.DropSize),
-		retryInterval: conf.RetryInterval,
+		retry:         newRetryPolicy(conf),
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+		batchFormat:   conf.BatchFormat,
 		URL:           fmt.Sprintf("http://%s:%d%s", conf.Host, conf.Port, conf.Path),
 	}
 }
@@ -38,21 +43,58 @@ func (q *HTTPLogForwardingQueue) intake() chan Log {
 }
 
 func (q *HTTPLogForwardingQueue) run() {
-	// Forwards payloads asynchronously
-	for logEntry := range q.Intake {
-		payload := buildPayload(&logEntry)
+	// Forwards payloads asynchronously, by batches
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+}
+
+// forward posts a batch of logs to the HTTP server, retrying the whole batch until it goes through
+// or the retry policy gives up on it
+func (q *HTTPLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	for i := range batch {
+		payloads = append(payloads, buildPayload(&batch[i]))
+	}
+
+	contentType, body, err := q.encode(payloads)
+	if err != nil {
+		log.Println("[ERROR][fluentd-middleware] Failed to Marshal payload:", err)
+		return
+	}
 
-		// Let's forward the log line to the http server
-		payloadBytes, err := json.Marshal(payload)
+	start := time.Now()
+	err = q.retry.run(func() error {
+		err := postToBackend(q.URL, contentType, body)
 		if err != nil {
-			log.Println("[ERROR][fluentd-middleware] Failed to Marshal payload")
-			continue
+			log.Printf("[WARNING][fluentd-middleware] Impossible to forward %d request log(s) to fluentd: %v", len(payloads), err)
 		}
+		return err
+	})
+	if err != nil {
+		q.retry.discard(payloads, err)
+		return
+	}
+	q.retry.metrics.Forwarded(len(payloads), len(body), time.Since(start))
+}
 
-		if _, err := http.Post(q.URL, "application/json", bytes.NewBuffer(payloadBytes)); err != nil {
-			log.Println("[WARNING][fluentd-middleware] Impossible to forward request log to fluentd:", err)
-			time.Sleep(q.retryInterval)
-			q.Intake <- logEntry
+// encode serializes a batch of logs to JSON. Unbatched logs are sent as a lone JSON object, like
+// they always were, batches are sent as a JSON array or as NDJSON
+func (q *HTTPLogForwardingQueue) encode(payloads []AccessLog) (contentType string, body []byte, err error) {
+	if q.batchSize <= 1 && len(payloads) == 1 {
+		body, err = json.Marshal(payloads[0])
+		return "application/json", body, err
+	}
+
+	if q.batchFormat == HTTPBatchNDJSON {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, payload := range payloads {
+			if err = encoder.Encode(payload); err != nil {
+				return
+			}
 		}
+		return "application/x-ndjson", buf.Bytes(), nil
 	}
+
+	body, err = json.Marshal(payloads)
+	return "application/json", body, err
 }
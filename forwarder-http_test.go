@@ -0,0 +1,159 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the HTTP forwarder posts logs by batches, as a JSON array or as NDJSON
+func TestHTTPForwarderBatching(t *testing.T) {
+	for _, format := range []int{HTTPBatchJSONArray, HTTPBatchNDJSON} {
+		// Let's setup a fake log collector that decodes whatever it receives
+		batches := make(chan []AccessLog, 10)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var batch []AccessLog
+			if format == HTTPBatchNDJSON {
+				assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+				scanner := bufio.NewScanner(r.Body)
+				for scanner.Scan() {
+					var entry AccessLog
+					assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+					batch = append(batch, entry)
+				}
+			} else {
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+			}
+			batches <- batch
+		}))
+		defer collector.Close()
+
+		host, port, _ := net.SplitHostPort(collector.Listener.Addr().String())
+		portNumber, _ := strconv.Atoi(port)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(New(AccessLoggerConfig{
+			Host:          host,
+			Port:          portNumber,
+			BatchSize:     3,
+			FlushInterval: 100 * time.Millisecond,
+			BatchFormat:   format,
+		}))
+		router.GET("/ping", func(c *gin.Context) {
+			c.Writer.Write([]byte("pong"))
+		})
+
+		for i := 0; i < 4; i++ {
+			r, _ := http.NewRequest("GET", "/ping", bytes.NewReader(nil))
+			router.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		// A full batch is sent right away, the remaining entry once the flush interval has elapsed
+		assert.Len(t, <-batches, 3, "First batch should be full")
+		assert.Len(t, <-batches, 1, "Second batch should contain the remaining entry")
+	}
+}
+
+// Test that non-2xx responses are retried and that logs end up in the dead letter callback once
+// the retry policy gave up
+func TestHTTPForwarderRetries(t *testing.T) {
+	var attempts int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(503)
+	}))
+	defer collector.Close()
+
+	host, port, _ := net.SplitHostPort(collector.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	deadLetters := make(chan []AccessLog, 1)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(New(AccessLoggerConfig{
+		Host:             host,
+		Port:             portNumber,
+		RetryInterval:    time.Millisecond,
+		RetryMaxAttempts: 3,
+		DeadLetter: func(entries []AccessLog, err error) {
+			assert.Contains(t, err.Error(), "503")
+			deadLetters <- entries
+		},
+	}))
+	router.GET("/ping", func(c *gin.Context) {})
+
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := <-deadLetters
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "/ping", entries[0].Request.Path)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts), "Batch should have been attempted 3 times")
+}
+
+// Test that requests the collector rejects as invalid aren't retried
+func TestHTTPForwarderRejections(t *testing.T) {
+	var attempts int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(400)
+	}))
+	defer collector.Close()
+
+	host, port, _ := net.SplitHostPort(collector.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	deadLetters := make(chan []AccessLog, 1)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(New(AccessLoggerConfig{
+		Host:             host,
+		Port:             portNumber,
+		RetryInterval:    time.Millisecond,
+		RetryMaxAttempts: 3,
+		DeadLetter: func(entries []AccessLog, err error) {
+			assert.Contains(t, err.Error(), "400")
+			deadLetters <- entries
+		},
+	}))
+	router.GET("/ping", func(c *gin.Context) {})
+
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Len(t, <-deadLetters, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts), "Rejected batch shouldn't have been retried")
+}
+
+// Test that retries are bounded by default, and that the interval never shrinks
+func TestRetryPolicyDefaults(t *testing.T) {
+	accessLogger := NewAccessLogger(AccessLoggerConfig{LogrusLogger: logrus.New(), RetryMultiplier: 0.5})
+	defer accessLogger.Shutdown(context.Background())
+	assert.Equal(t, 15*time.Minute, accessLogger.conf.RetryMaxElapsedTime)
+	assert.Equal(t, float64(2), accessLogger.conf.RetryMultiplier)
+
+	policy := newRetryPolicy(AccessLoggerConfig{RetryMultiplier: 0.5})
+	assert.Equal(t, float64(1), policy.multiplier)
+
+	attempts := 0
+	err := policy.run(func() error {
+		attempts++
+		return permanent(errors.New("invalid"))
+	})
+	assert.EqualError(t, err, "invalid")
+	assert.Equal(t, 1, attempts)
+}
@@ -12,6 +12,7 @@ type LogrusLogForwardingQueue struct {
 	Intake        chan Log
 	logrusLogger  *logrus.Logger
 	retryInterval time.Duration
+	metrics       Metrics
 }
 
 // NewLogrusLogForwardingQueue returns a such a forwarding queue
@@ -19,6 +20,7 @@ func NewLogrusLogForwardingQueue(conf AccessLoggerConfig) (q *LogrusLogForwardin
 	return &LogrusLogForwardingQueue{
 		Intake:       make(chan Log, conf.DropSize),
 		logrusLogger: conf.LogrusLogger,
+		metrics:      pipelineMetrics(conf),
 	}
 }
 
@@ -28,31 +30,42 @@ func (q *LogrusLogForwardingQueue) intake() chan Log {
 
 func (q *LogrusLogForwardingQueue) run() {
 	// Forwards payloads asynchronously
-	for {
-		logEntry := (<-q.Intake)
-		payload := buildPayload(&logEntry)
-
-		// Let's convert our fields to their JSON counterparts before logging fields as JSON
-		payloadBytes, err := json.Marshal(payload)
-		if err != nil {
-			logrus.Errorf("Impossible to marshal log payload to JSON: %v (payload: %v)", err, payload)
-			continue
-		}
-		var payloadJSON map[string]interface{}
-		err = json.Unmarshal(payloadBytes, &payloadJSON)
-		if err != nil {
-			logrus.Errorf("Impossible to unmarshal log payload into map[string]interface{}: %v (payload: %s)", err, payloadBytes)
+	for logEntry := range q.Intake {
+		if logEntry.flushed != nil {
+			close(logEntry.flushed)
 			continue
 		}
+		q.forward(&logEntry)
+		logsHandled([]Log{logEntry})
+	}
+}
 
-		// Let's forward the log line to fluentd
-		logger := q.logrusLogger.WithFields(payloadJSON)
-		if payload.Response.Status >= 500 {
-			logger.Error("server error")
-		} else if payload.Response.Status >= 400 {
-			logger.Warn("client error")
-		} else {
-			logger.Info("request processed")
-		}
+func (q *LogrusLogForwardingQueue) forward(logEntry *Log) {
+	start := time.Now()
+	payload := buildPayload(logEntry)
+
+	// Let's convert our fields to their JSON counterparts before logging fields as JSON
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		logrus.Errorf("Impossible to marshal log payload to JSON: %v (payload: %v)", err, payload)
+		return
+	}
+	var payloadJSON map[string]interface{}
+	err = json.Unmarshal(payloadBytes, &payloadJSON)
+	if err != nil {
+		logrus.Errorf("Impossible to unmarshal log payload into map[string]interface{}: %v (payload: %s)", err, payloadBytes)
+		return
+	}
+
+	// Let's forward the log line to fluentd
+	logger := q.logrusLogger.WithFields(payloadJSON)
+	switch statusLevel(payload.Response.Status) {
+	case logrus.ErrorLevel:
+		logger.Error("server error")
+	case logrus.WarnLevel:
+		logger.Warn("client error")
+	default:
+		logger.Info("request processed")
 	}
+	q.metrics.Forwarded(1, len(payloadBytes), time.Since(start))
 }
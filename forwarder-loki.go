@@ -0,0 +1,275 @@
+package ginhttplogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Labels logs can be grouped by into Loki streams, on top of AccessLoggerConfig.LokiLabels
+const (
+	LokiLabelMethod      = "method"
+	LokiLabelStatusClass = "status_class"
+	LokiLabelRoute       = "route"
+)
+
+// lokiStreamTTL is how long we remember the last timestamp of a stream, after its last entry
+const lokiStreamTTL = time.Hour
+
+// DefaultLokiStreamLabels are the labels logs are grouped by when
+// AccessLoggerConfig.LokiStreamLabels isn't set
+var DefaultLokiStreamLabels = []string{LokiLabelMethod, LokiLabelStatusClass}
+
+// LokiLogForwardingQueue pushes logs to Grafana Loki
+type LokiLogForwardingQueue struct {
+	Intake        chan Log
+	retry         retryPolicy
+	batchSize     int
+	flushInterval time.Duration
+	labels        map[string]string
+	streamLabels  []string
+	protobuf      bool
+	URL           string
+
+	// lastTimestamps holds the timestamp of the last entry pushed to each stream, Loki doesn't
+	// accept entries older than that
+	lastTimestamps map[string]int64
+}
+
+// lokiStream is a set of entries sharing the same labels
+type lokiStream struct {
+	labels  map[string]string
+	key     string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp int64
+	line      string
+}
+
+// NewLokiLogForwardingQueue builds a log forwarding queue that pushes entries to Loki, by batches
+// of BatchSize entries
+func NewLokiLogForwardingQueue(conf AccessLoggerConfig) (q *LokiLogForwardingQueue) {
+	streamLabels := conf.LokiStreamLabels
+	if streamLabels == nil {
+		streamLabels = DefaultLokiStreamLabels
+	}
+	return &LokiLogForwardingQueue{
+		Intake:         make(chan Log, conf.DropSize),
+		retry:          newRetryPolicy(conf),
+		batchSize:      conf.BatchSize,
+		flushInterval:  conf.FlushInterval,
+		labels:         conf.LokiLabels,
+		streamLabels:   streamLabels,
+		protobuf:       conf.LokiProtobuf,
+		URL:            strings.TrimRight(backendURL(conf), "/") + "/loki/api/v1/push",
+		lastTimestamps: make(map[string]int64),
+	}
+}
+
+func (q *LokiLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *LokiLogForwardingQueue) run() {
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+}
+
+// forward pushes a batch of logs to Loki, retrying the whole batch until it goes through or the
+// retry policy gives up on it. Batches Loki rejects as invalid (4xx) are discarded right away.
+func (q *LokiLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	for i := range batch {
+		payloads = append(payloads, buildPayload(&batch[i]))
+	}
+
+	streams, err := q.streams(payloads)
+	if err != nil {
+		log.Println("[ERROR][loki-middleware] Failed to Marshal payload:", err)
+		q.retry.discard(payloads, err)
+		return
+	}
+
+	encode, contentType := q.encodeJSON, "application/json"
+	if q.protobuf {
+		encode, contentType = q.encodeProtobuf, "application/x-protobuf"
+	}
+	data, err := encode(streams)
+	if err != nil {
+		log.Println("[ERROR][loki-middleware] Failed to Marshal payload:", err)
+		q.retry.discard(payloads, err)
+		return
+	}
+
+	start := time.Now()
+	err = q.retry.run(func() error {
+		err := postToBackend(q.URL, contentType, data)
+		if err != nil {
+			log.Printf("[WARNING][loki-middleware] Impossible to push %d request log(s) to Loki: %v", len(payloads), err)
+		}
+		return err
+	})
+	if err != nil {
+		q.retry.discard(payloads, err)
+		return
+	}
+
+	for _, stream := range streams {
+		q.lastTimestamps[stream.key] = stream.entries[len(stream.entries)-1].timestamp
+	}
+	q.forgetStreams(time.Now())
+	q.retry.metrics.Forwarded(len(payloads), len(data), time.Since(start))
+}
+
+// forgetStreams drops the last timestamps of the streams we haven't pushed recent entries to, not
+// to keep track of every stream we ever pushed to. Loki doesn't accept entries lagging that much
+// behind the newest ones of a stream anyway.
+func (q *LokiLogForwardingQueue) forgetStreams(now time.Time) {
+	horizon := now.Add(-lokiStreamTTL).UnixNano()
+	for key, timestamp := range q.lastTimestamps {
+		if timestamp < horizon {
+			delete(q.lastTimestamps, key)
+		}
+	}
+}
+
+// streams groups logs by labels. Entries are sorted by timestamp within each stream, and entries
+// older than the last one pushed to their stream are pushed with its timestamp, since Loki would
+// reject them otherwise (their actual start time is still in the line).
+func (q *LokiLogForwardingQueue) streams(payloads []AccessLog) ([]*lokiStream, error) {
+	var streams []*lokiStream
+	byKey := make(map[string]*lokiStream)
+	for _, payload := range payloads {
+		line, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		labels := q.streamLabelsOf(&payload)
+		key := lokiLabelsString(labels)
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{labels: labels, key: key}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{payload.startDate.UnixNano(), string(line)})
+	}
+
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timestamp < stream.entries[j].timestamp
+		})
+		if last, ok := q.lastTimestamps[stream.key]; ok {
+			for i := range stream.entries {
+				if stream.entries[i].timestamp < last {
+					stream.entries[i].timestamp = last
+				}
+			}
+		}
+	}
+	return streams, nil
+}
+
+// streamLabelsOf returns the labels of the stream a log belongs to
+func (q *LokiLogForwardingQueue) streamLabelsOf(payload *AccessLog) map[string]string {
+	labels := make(map[string]string, len(q.labels)+len(q.streamLabels))
+	for name, value := range q.labels {
+		labels[name] = value
+	}
+	for _, name := range q.streamLabels {
+		switch name {
+		case LokiLabelMethod:
+			labels[name] = normalizeMethod(payload.Request.Method)
+		case LokiLabelStatusClass:
+			labels[name] = fmt.Sprintf("%dxx", payload.Response.Status/100)
+		case LokiLabelRoute:
+			if payload.Request.Route != "" {
+				labels[name] = payload.Request.Route
+			}
+		}
+	}
+	return labels
+}
+
+// lokiLabelsString formats labels the way Loki (and Prometheus) does: {a="b", c="d"}
+func lokiLabelsString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(strconv.Quote(labels[name]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// encodeJSON serializes streams as a JSON push request
+func (q *LokiLogForwardingQueue) encodeJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		values := make([][2]string, 0, len(stream.entries))
+		for _, entry := range stream.entries {
+			values = append(values, [2]string{strconv.FormatInt(entry.timestamp, 10), entry.line})
+		}
+		request.Streams = append(request.Streams, jsonStream{stream.labels, values})
+	}
+	return json.Marshal(request)
+}
+
+// encodeProtobuf serializes streams as a snappy-compressed logproto.PushRequest:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func (q *LokiLogForwardingQueue) encodeProtobuf(streams []*lokiStream) ([]byte, error) {
+	var request []byte
+	for _, stream := range streams {
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendString(message, stream.key)
+		for _, entry := range stream.entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp/int64(time.Second)))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp%int64(time.Second)))
+
+			var entryMessage []byte
+			entryMessage = protowire.AppendTag(entryMessage, 1, protowire.BytesType)
+			entryMessage = protowire.AppendBytes(entryMessage, timestamp)
+			entryMessage = protowire.AppendTag(entryMessage, 2, protowire.BytesType)
+			entryMessage = protowire.AppendString(entryMessage, entry.line)
+
+			message = protowire.AppendTag(message, 2, protowire.BytesType)
+			message = protowire.AppendBytes(message, entryMessage)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, message)
+	}
+	return snappy.Encode(nil, request), nil
+}
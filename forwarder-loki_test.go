@@ -0,0 +1,166 @@
+package ginhttplogger
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type lokiPushRequest struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+// Test that logs are pushed to Loki as JSON, grouped into streams by labels
+func TestLokiForwarderJSON(t *testing.T) {
+	requests := make(chan lokiPushRequest, 10)
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var request lokiPushRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requests <- request
+		w.WriteHeader(204)
+	}))
+	defer loki.Close()
+
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:         ProtocolLoki,
+		URL:              loki.URL,
+		BatchSize:        3,
+		LokiLabels:       map[string]string{"service": "api"},
+		LokiStreamLabels: []string{LokiLabelMethod, LokiLabelStatusClass, LokiLabelRoute},
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"), testRequest("GET", "/users/2"))
+
+	request := <-requests
+	if assert.Len(t, request.Streams, 2) {
+		assert.Equal(t, map[string]string{"service": "api", "method": "GET", "status_class": "2xx", "route": "/users/:id"}, request.Streams[0].Stream)
+		assert.Len(t, request.Streams[0].Values, 2)
+		assert.Equal(t, map[string]string{"service": "api", "method": "POST", "status_class": "4xx", "route": "/users"}, request.Streams[1].Stream)
+		assert.Len(t, request.Streams[1].Values, 1)
+
+		// Entries are timestamped with the start date of the requests, and hold the whole log
+		first, second := request.Streams[0].Values[0], request.Streams[0].Values[1]
+		assert.True(t, first[0] <= second[0])
+		var payload AccessLog
+		assert.NoError(t, json.Unmarshal([]byte(first[1]), &payload))
+		assert.Equal(t, "/users/1", payload.Request.Path)
+	}
+}
+
+// Test that push requests can be sent as snappy-compressed protobuf
+func TestLokiForwarderProtobuf(t *testing.T) {
+	labels := make(chan []string, 10)
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		compressed, _ := io.ReadAll(r.Body)
+		request, err := snappy.Decode(nil, compressed)
+		assert.NoError(t, err)
+
+		// Let's walk through PushRequest.streams, and read the labels and number of entries of each
+		var streams []string
+		for len(request) > 0 {
+			_, _, n := protowire.ConsumeTag(request)
+			stream, m := protowire.ConsumeBytes(request[n:])
+			request = request[n+m:]
+			entries := 0
+			for len(stream) > 0 {
+				number, _, n := protowire.ConsumeTag(stream)
+				value, m := protowire.ConsumeBytes(stream[n:])
+				stream = stream[n+m:]
+				if number == 1 {
+					streams = append(streams, string(value))
+				} else {
+					entries++
+				}
+			}
+			streams = append(streams, strconv.Itoa(entries))
+		}
+		labels <- streams
+	}))
+	defer loki.Close()
+
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:     ProtocolLoki,
+		URL:          loki.URL,
+		BatchSize:    3,
+		LokiProtobuf: true,
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"), testRequest("GET", "/users/2"))
+
+	assert.Equal(t, []string{`{method="GET", status_class="2xx"}`, "2", `{method="POST", status_class="4xx"}`, "1"}, <-labels)
+}
+
+// Test that batches Loki rejects as invalid aren't retried
+func TestLokiForwarderRejections(t *testing.T) {
+	var attempts int32
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "entry too far behind", 400)
+	}))
+	defer loki.Close()
+
+	deadLetters := make(chan []AccessLog, 1)
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:         ProtocolLoki,
+		URL:              loki.URL,
+		BatchSize:        3,
+		RetryInterval:    time.Millisecond,
+		RetryMaxAttempts: 3,
+		DeadLetter: func(entries []AccessLog, err error) {
+			assert.Contains(t, err.Error(), "entry too far behind")
+			deadLetters <- entries
+		},
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"), testRequest("GET", "/users/2"))
+
+	assert.Len(t, <-deadLetters, 3)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+// Test that entries are ordered within streams, and never older than what was already pushed
+func TestLokiStreamOrdering(t *testing.T) {
+	q := NewLokiLogForwardingQueue(AccessLoggerConfig{})
+	base := time.Date(2017, 7, 14, 10, 0, 0, 0, time.UTC)
+	payload := func(offset time.Duration) AccessLog {
+		p := AccessLog{Request: RequestLogEntry{Method: "GET"}, Response: ResponseLogEntry{Status: 200}}
+		p.startDate = base.Add(offset)
+		return p
+	}
+
+	q.lastTimestamps[`{method="GET", status_class="2xx"}`] = base.Add(2 * time.Second).UnixNano()
+	streams, err := q.streams([]AccessLog{payload(3 * time.Second), payload(time.Second), payload(4 * time.Second)})
+	assert.NoError(t, err)
+	if assert.Len(t, streams, 1) {
+		var timestamps []int64
+		for _, entry := range streams[0].entries {
+			timestamps = append(timestamps, entry.timestamp)
+		}
+		assert.Equal(t, []int64{
+			base.Add(2 * time.Second).UnixNano(),
+			base.Add(3 * time.Second).UnixNano(),
+			base.Add(4 * time.Second).UnixNano(),
+		}, timestamps)
+	}
+
+	// Streams without recent entries are forgotten
+	q.lastTimestamps[`{method="POST", status_class="2xx"}`] = base.Add(time.Hour).UnixNano()
+	q.forgetStreams(base.Add(90 * time.Minute))
+	assert.Equal(t, map[string]int64{`{method="POST", status_class="2xx"}`: base.Add(time.Hour).UnixNano()}, q.lastTimestamps)
+}
+
+// Test that methods clients make up don't make new streams
+func TestLokiStreamLabels(t *testing.T) {
+	q := NewLokiLogForwardingQueue(AccessLoggerConfig{})
+	payload := AccessLog{Request: RequestLogEntry{Method: "PROPFIND"}, Response: ResponseLogEntry{Status: 207}}
+	assert.Equal(t, map[string]string{"method": "OTHER", "status_class": "2xx"}, q.streamLabelsOf(&payload))
+}
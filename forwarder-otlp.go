@@ -0,0 +1,308 @@
+package ginhttplogger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpScopeName is the instrumentation scope of the log records we export
+const otlpScopeName = "github.com/elafarge/gin-http-logger"
+
+// OTLP severity numbers of the log records
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+)
+
+// otlpSeverities maps log levels to OTLP severity numbers and texts
+var otlpSeverities = map[logrus.Level]struct {
+	number int
+	text   string
+}{
+	logrus.ErrorLevel: {otlpSeverityError, "ERROR"},
+	logrus.WarnLevel:  {otlpSeverityWarn, "WARN"},
+	logrus.InfoLevel:  {otlpSeverityInfo, "INFO"},
+}
+
+// OTLPLogForwardingQueue exports logs to an OpenTelemetry collector over OTLP/HTTP
+type OTLPLogForwardingQueue struct {
+	Intake             chan Log
+	retry              retryPolicy
+	batchSize          int
+	flushInterval      time.Duration
+	resourceAttributes []otlpAttribute
+	protobuf           bool
+	URL                string
+}
+
+// otlpAttribute is a key-value pair, values being strings, int64 or float64
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// otlpLogRecord is the OTLP LogRecord an AccessLog maps to
+type otlpLogRecord struct {
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       int
+	severityText         string
+	body                 string
+	attributes           []otlpAttribute
+	traceID              []byte
+}
+
+// NewOTLPLogForwardingQueue builds a log forwarding queue that exports entries to an OpenTelemetry
+// collector, by batches of BatchSize log records
+func NewOTLPLogForwardingQueue(conf AccessLoggerConfig) (q *OTLPLogForwardingQueue) {
+	q = &OTLPLogForwardingQueue{
+		Intake:        make(chan Log, conf.DropSize),
+		retry:         newRetryPolicy(conf),
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+		protobuf:      conf.OTLPProtobuf,
+		URL:           strings.TrimRight(backendURL(conf), "/") + "/v1/logs",
+	}
+
+	names := make([]string, 0, len(conf.OTLPResourceAttributes))
+	for name := range conf.OTLPResourceAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		q.resourceAttributes = append(q.resourceAttributes, otlpAttribute{name, conf.OTLPResourceAttributes[name]})
+	}
+	return q
+}
+
+func (q *OTLPLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *OTLPLogForwardingQueue) run() {
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+}
+
+// forward exports a batch of logs, retrying the whole batch until it goes through or the retry
+// policy gives up on it. Batches the collector rejects as invalid (4xx) are discarded right away.
+func (q *OTLPLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	records := make([]otlpLogRecord, 0, len(batch))
+	for i := range batch {
+		payload := buildPayload(&batch[i])
+		record, err := newOTLPLogRecord(&payload)
+		if err != nil {
+			log.Println("[ERROR][otlp-middleware] Failed to Marshal payload:", err)
+			q.retry.discard([]AccessLog{payload}, err)
+			continue
+		}
+		payloads = append(payloads, payload)
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	encode, contentType := q.encodeJSON, "application/json"
+	if q.protobuf {
+		encode, contentType = q.encodeProtobuf, "application/x-protobuf"
+	}
+	body, err := encode(records)
+	if err != nil {
+		log.Println("[ERROR][otlp-middleware] Failed to Marshal payload:", err)
+		q.retry.discard(payloads, err)
+		return
+	}
+
+	start := time.Now()
+	err = q.retry.run(func() error {
+		err := postToBackend(q.URL, contentType, body)
+		if err != nil {
+			log.Printf("[WARNING][otlp-middleware] Impossible to export %d request log(s): %v", len(payloads), err)
+		}
+		return err
+	})
+	if err != nil {
+		q.retry.discard(payloads, err)
+		return
+	}
+	q.retry.metrics.Forwarded(len(payloads), len(body), time.Since(start))
+}
+
+// newOTLPLogRecord maps an AccessLog to a LogRecord, following the semantic conventions for HTTP
+// (https://opentelemetry.io/docs/specs/semconv/http/). The body is the whole log, as JSON.
+func newOTLPLogRecord(payload *AccessLog) (record otlpLogRecord, err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return record, err
+	}
+
+	record = otlpLogRecord{
+		timeUnixNano:         uint64(payload.startDate.UnixNano()),
+		observedTimeUnixNano: uint64(time.Now().UnixNano()),
+		body:                 string(body),
+	}
+	severity := otlpSeverities[statusLevel(payload.Response.Status)]
+	record.severityNumber, record.severityText = severity.number, severity.text
+
+	attributes := []otlpAttribute{
+		{"http.request.method", payload.Request.Method},
+		{"url.path", payload.Request.Path},
+	}
+	if payload.Request.Query != "" {
+		attributes = append(attributes, otlpAttribute{"url.query", payload.Request.Query})
+	}
+	if payload.Request.Route != "" {
+		attributes = append(attributes, otlpAttribute{"http.route", payload.Request.Route})
+	}
+	attributes = append(attributes, otlpAttribute{"http.response.status_code", int64(payload.Response.Status)})
+	if payload.Response.Status >= 500 {
+		attributes = append(attributes, otlpAttribute{"error.type", strconv.Itoa(payload.Response.Status)})
+	}
+	if payload.ClientAddress != "" {
+		attributes = append(attributes, otlpAttribute{"client.address", payload.ClientAddress})
+	}
+	if version := strings.TrimPrefix(payload.Request.HTTPVersion, "HTTP/"); version != "" {
+		attributes = append(attributes, otlpAttribute{"network.protocol.version", version})
+	}
+	if payload.userAgent != "" {
+		attributes = append(attributes, otlpAttribute{"user_agent.original", payload.userAgent})
+	}
+	if payload.Request.Content.Size >= 0 {
+		attributes = append(attributes, otlpAttribute{"http.request.body.size", payload.Request.Content.Size})
+	}
+	attributes = append(attributes, otlpAttribute{"http.response.body.size", payload.Response.Content.Size})
+	attributes = append(attributes, otlpAttribute{"http.server.request.duration", payload.latency.Seconds()})
+	if payload.RequestID != "" {
+		attributes = append(attributes, otlpAttribute{"http.request.id", payload.RequestID})
+	}
+	record.attributes = attributes
+
+	// Trace IDs were checked when the trace context was parsed. Records aren't given a span ID: the
+	// one we know of is the caller's, not the one of the span of the request.
+	if payload.TraceID != "" {
+		record.traceID, _ = hex.DecodeString(payload.TraceID)
+	}
+	return record, nil
+}
+
+// encodeJSON serializes log records as an ExportLogsServiceRequest, following the OTLP/JSON
+// mapping: 64 bits integers are strings, trace IDs are hex-encoded
+func (q *OTLPLogForwardingQueue) encodeJSON(records []otlpLogRecord) ([]byte, error) {
+	jsonAttributes := func(attributes []otlpAttribute) []map[string]interface{} {
+		values := make([]map[string]interface{}, 0, len(attributes))
+		for _, attribute := range attributes {
+			var value map[string]interface{}
+			switch v := attribute.value.(type) {
+			case int64:
+				value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+			case float64:
+				value = map[string]interface{}{"doubleValue": v}
+			default:
+				value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+			}
+			values = append(values, map[string]interface{}{"key": attribute.key, "value": value})
+		}
+		return values
+	}
+
+	logRecords := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		logRecord := map[string]interface{}{
+			"timeUnixNano":         strconv.FormatUint(record.timeUnixNano, 10),
+			"observedTimeUnixNano": strconv.FormatUint(record.observedTimeUnixNano, 10),
+			"severityNumber":       record.severityNumber,
+			"severityText":         record.severityText,
+			"body":                 map[string]interface{}{"stringValue": record.body},
+			"attributes":           jsonAttributes(record.attributes),
+		}
+		if len(record.traceID) > 0 {
+			logRecord["traceId"] = hex.EncodeToString(record.traceID)
+		}
+		logRecords = append(logRecords, logRecord)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": jsonAttributes(q.resourceAttributes)},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": otlpScopeName},
+				"logRecords": logRecords,
+			}},
+		}},
+	})
+}
+
+// encodeProtobuf serializes log records as an ExportLogsServiceRequest (see
+// https://github.com/open-telemetry/opentelemetry-proto for the field numbers below)
+func (q *OTLPLogForwardingQueue) encodeProtobuf(records []otlpLogRecord) ([]byte, error) {
+	appendMessage := func(b []byte, number protowire.Number, message []byte) []byte {
+		b = protowire.AppendTag(b, number, protowire.BytesType)
+		return protowire.AppendBytes(b, message)
+	}
+	appendString := func(b []byte, number protowire.Number, s string) []byte {
+		b = protowire.AppendTag(b, number, protowire.BytesType)
+		return protowire.AppendString(b, s)
+	}
+	// KeyValue { string key = 1; AnyValue value = 2; }
+	// AnyValue { string string_value = 1; int64 int_value = 3; double double_value = 4; }
+	appendAttributes := func(b []byte, number protowire.Number, attributes []otlpAttribute) []byte {
+		for _, attribute := range attributes {
+			var value []byte
+			switch v := attribute.value.(type) {
+			case int64:
+				value = protowire.AppendTag(value, 3, protowire.VarintType)
+				value = protowire.AppendVarint(value, uint64(v))
+			case float64:
+				value = protowire.AppendTag(value, 4, protowire.Fixed64Type)
+				value = protowire.AppendFixed64(value, math.Float64bits(v))
+			default:
+				value = appendString(value, 1, fmt.Sprint(v))
+			}
+			keyValue := appendString(nil, 1, attribute.key)
+			keyValue = appendMessage(keyValue, 2, value)
+			b = appendMessage(b, number, keyValue)
+		}
+		return b
+	}
+
+	// ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+	scopeLogs := appendMessage(nil, 1, appendString(nil, 1, otlpScopeName))
+	for _, record := range records {
+		// LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+		// string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6;
+		// bytes trace_id = 9; fixed64 observed_time_unix_nano = 11; }
+		var logRecord []byte
+		logRecord = protowire.AppendTag(logRecord, 1, protowire.Fixed64Type)
+		logRecord = protowire.AppendFixed64(logRecord, record.timeUnixNano)
+		logRecord = protowire.AppendTag(logRecord, 2, protowire.VarintType)
+		logRecord = protowire.AppendVarint(logRecord, uint64(record.severityNumber))
+		logRecord = appendString(logRecord, 3, record.severityText)
+		logRecord = appendMessage(logRecord, 5, appendString(nil, 1, record.body))
+		logRecord = appendAttributes(logRecord, 6, record.attributes)
+		if len(record.traceID) > 0 {
+			logRecord = appendMessage(logRecord, 9, record.traceID)
+		}
+		logRecord = protowire.AppendTag(logRecord, 11, protowire.Fixed64Type)
+		logRecord = protowire.AppendFixed64(logRecord, record.observedTimeUnixNano)
+		scopeLogs = appendMessage(scopeLogs, 2, logRecord)
+	}
+
+	// ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+	// ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+	// Resource { repeated KeyValue attributes = 1; }
+	resourceLogs := appendMessage(nil, 1, appendAttributes(nil, 1, q.resourceAttributes))
+	resourceLogs = appendMessage(resourceLogs, 2, scopeLogs)
+	return appendMessage(nil, 1, resourceLogs), nil
+}
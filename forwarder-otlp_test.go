@@ -0,0 +1,278 @@
+package ginhttplogger
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type otlpJSONValue struct {
+	StringValue *string  `json:"stringValue"`
+	IntValue    *string  `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+}
+
+type otlpJSONAttribute struct {
+	Key   string        `json:"key"`
+	Value otlpJSONValue `json:"value"`
+}
+
+type otlpExportRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			LogRecords []struct {
+				TimeUnixNano   string              `json:"timeUnixNano"`
+				SeverityNumber int                 `json:"severityNumber"`
+				SeverityText   string              `json:"severityText"`
+				Body           otlpJSONValue       `json:"body"`
+				Attributes     []otlpJSONAttribute `json:"attributes"`
+				TraceID        string              `json:"traceId"`
+				SpanID         string              `json:"spanId"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+// value returns the value of an OTLP/JSON attribute, whatever its type
+func (a otlpJSONAttribute) value() interface{} {
+	switch {
+	case a.Value.StringValue != nil:
+		return *a.Value.StringValue
+	case a.Value.IntValue != nil:
+		return *a.Value.IntValue
+	case a.Value.DoubleValue != nil:
+		return *a.Value.DoubleValue
+	}
+	return nil
+}
+
+// otlpRequests returns a successful request, which carries a trace context, and a failed one
+func otlpRequests() []*http.Request {
+	get := testRequest("GET", "/users/1?debug=1")
+	get.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	return []*http.Request{get, testRequest("DELETE", "/users/1")}
+}
+
+// Test that logs are exported as OTLP/JSON log records, following the HTTP semantic conventions
+func TestOTLPForwarderJSON(t *testing.T) {
+	requests := make(chan otlpExportRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var request otlpExportRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requests <- request
+	}))
+	defer collector.Close()
+
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:               ProtocolOTLP,
+		URL:                    collector.URL,
+		BatchSize:              2,
+		OTLPResourceAttributes: map[string]string{"service.name": "api"},
+		// Neither affects attributes
+		DurationUnit:   DurationMilliseconds,
+		HeaderDenyList: []string{"User-Agent"},
+	}, otlpRequests()...)
+
+	request := <-requests
+	if !assert.Len(t, request.ResourceLogs, 1) || !assert.Len(t, request.ResourceLogs[0].ScopeLogs, 1) {
+		return
+	}
+	resourceLogs := request.ResourceLogs[0]
+	assert.Equal(t, []otlpJSONAttribute{{"service.name", otlpJSONValue{StringValue: &[]string{"api"}[0]}}}, resourceLogs.Resource.Attributes)
+	assert.Equal(t, otlpScopeName, resourceLogs.ScopeLogs[0].Scope.Name)
+
+	records := resourceLogs.ScopeLogs[0].LogRecords
+	if !assert.Len(t, records, 2) {
+		return
+	}
+
+	get := records[0]
+	assert.NotEmpty(t, get.TimeUnixNano)
+	assert.Equal(t, otlpSeverityInfo, get.SeverityNumber)
+	assert.Equal(t, "INFO", get.SeverityText)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", get.TraceID)
+	assert.Empty(t, get.SpanID)
+
+	attributes := make(map[string]interface{})
+	for _, attribute := range get.Attributes {
+		attributes[attribute.Key] = attribute.value()
+	}
+	// Fast requests take 0ms, the duration isn't rounded though
+	if assert.IsType(t, float64(0), attributes["http.server.request.duration"]) {
+		assert.True(t, attributes["http.server.request.duration"].(float64) > 0)
+	}
+	delete(attributes, "http.server.request.duration")
+	assert.NotEmpty(t, attributes["http.request.id"])
+	delete(attributes, "http.request.id")
+	assert.Equal(t, map[string]interface{}{
+		"http.request.method":       "GET",
+		"url.path":                  "/users/1",
+		"url.query":                 "debug=1",
+		"http.route":                "/users/:id",
+		"http.response.status_code": "200",
+		"network.protocol.version":  "1.1",
+		"user_agent.original":       "curl/8.0",
+		"http.request.body.size":    "0",
+		"http.response.body.size":   "5",
+	}, attributes)
+
+	// The body holds the whole log
+	var payload AccessLog
+	if assert.NotNil(t, get.Body.StringValue) {
+		assert.NoError(t, json.Unmarshal([]byte(*get.Body.StringValue), &payload))
+		assert.Equal(t, "/users/1", payload.Request.Path)
+	}
+
+	failed := records[1]
+	assert.Equal(t, otlpSeverityError, failed.SeverityNumber)
+	assert.Equal(t, "ERROR", failed.SeverityText)
+	assert.Empty(t, failed.TraceID)
+	for _, attribute := range failed.Attributes {
+		if attribute.Key == "error.type" {
+			assert.Equal(t, "503", attribute.value())
+		}
+	}
+}
+
+// Test that export requests can be sent as protobuf
+func TestOTLPForwarderProtobuf(t *testing.T) {
+	type logRecord struct {
+		severity   uint64
+		traceID    []byte
+		statusCode uint64
+		duration   float64
+	}
+	records := make(chan []logRecord, 10)
+
+	// consume walks through the fields of a message
+	consume := func(message []byte, field func(number protowire.Number, typ protowire.Type, value []byte, varint uint64)) {
+		for len(message) > 0 {
+			number, typ, n := protowire.ConsumeTag(message)
+			message = message[n:]
+			switch typ {
+			case protowire.BytesType:
+				value, m := protowire.ConsumeBytes(message)
+				field(number, typ, value, 0)
+				message = message[m:]
+			case protowire.VarintType:
+				value, m := protowire.ConsumeVarint(message)
+				field(number, typ, nil, value)
+				message = message[m:]
+			case protowire.Fixed64Type:
+				value, m := protowire.ConsumeFixed64(message)
+				field(number, typ, nil, value)
+				message = message[m:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		request, _ := io.ReadAll(r.Body)
+
+		// ExportLogsServiceRequest > ResourceLogs > ScopeLogs > LogRecord
+		var found []logRecord
+		consume(request, func(_ protowire.Number, _ protowire.Type, resourceLogs []byte, _ uint64) {
+			consume(resourceLogs, func(number protowire.Number, _ protowire.Type, scopeLogs []byte, _ uint64) {
+				if number != 2 {
+					return
+				}
+				consume(scopeLogs, func(number protowire.Number, _ protowire.Type, message []byte, _ uint64) {
+					if number != 2 {
+						return
+					}
+					var record logRecord
+					consume(message, func(number protowire.Number, _ protowire.Type, value []byte, varint uint64) {
+						switch number {
+						case 2:
+							record.severity = varint
+						case 9:
+							record.traceID = value
+						case 6:
+							var key string
+							consume(value, func(number protowire.Number, _ protowire.Type, value []byte, _ uint64) {
+								if number == 1 {
+									key = string(value)
+									return
+								}
+								consume(value, func(_ protowire.Number, _ protowire.Type, _ []byte, varint uint64) {
+									switch key {
+									case "http.response.status_code":
+										record.statusCode = varint
+									case "http.server.request.duration":
+										record.duration = math.Float64frombits(varint)
+									}
+								})
+							})
+						}
+					})
+					found = append(found, record)
+				})
+			})
+		})
+		records <- found
+	}))
+	defer collector.Close()
+
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:     ProtocolOTLP,
+		URL:          collector.URL,
+		BatchSize:    2,
+		OTLPProtobuf: true,
+	}, otlpRequests()...)
+
+	found := <-records
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, uint64(otlpSeverityInfo), found[0].severity)
+		assert.Equal(t, []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}, found[0].traceID)
+		assert.Equal(t, uint64(200), found[0].statusCode)
+		assert.True(t, found[0].duration > 0)
+		assert.Equal(t, uint64(otlpSeverityError), found[1].severity)
+		assert.Nil(t, found[1].traceID)
+		assert.Equal(t, uint64(503), found[1].statusCode)
+	}
+}
+
+// Test that export requests the collector rejects as invalid aren't retried
+func TestOTLPForwarderRejections(t *testing.T) {
+	var attempts int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "invalid log record", 400)
+	}))
+	defer collector.Close()
+
+	deadLetters := make(chan []AccessLog, 1)
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:         ProtocolOTLP,
+		URL:              collector.URL,
+		BatchSize:        2,
+		RetryInterval:    time.Millisecond,
+		RetryMaxAttempts: 3,
+		DeadLetter: func(entries []AccessLog, err error) {
+			assert.Contains(t, err.Error(), "invalid log record")
+			deadLetters <- entries
+		},
+	}, otlpRequests()...)
+
+	assert.Len(t, <-deadLetters, 2)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
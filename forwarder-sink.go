@@ -0,0 +1,67 @@
+package ginhttplogger
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// LogSink can be implemented to ship access logs to any system. Set it as AccessLoggerConfig.Sink
+// and the middleware will hand it every log, from a single goroutine.
+type LogSink interface {
+	// Send delivers an access log. When an error is returned, the same log is sent again according
+	// to the retry policy, sinks that would rather drop it should log the error and return nil.
+	Send(ctx context.Context, entry *AccessLog) error
+}
+
+// SinkLogForwardingQueue forwards logs to a user-provided LogSink
+type SinkLogForwardingQueue struct {
+	Intake  chan Log
+	sink    LogSink
+	timeout time.Duration
+	retry   retryPolicy
+}
+
+// NewSinkLogForwardingQueue builds a log forwarding queue that hands entries to conf.Sink
+func NewSinkLogForwardingQueue(conf AccessLoggerConfig) (q *SinkLogForwardingQueue) {
+	return &SinkLogForwardingQueue{
+		Intake:  make(chan Log, conf.DropSize),
+		sink:    conf.Sink,
+		timeout: conf.SinkTimeout,
+		retry:   newRetryPolicy(conf),
+	}
+}
+
+func (q *SinkLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *SinkLogForwardingQueue) run() {
+	// Forwards payloads asynchronously
+	for logEntry := range q.Intake {
+		if logEntry.flushed != nil {
+			close(logEntry.flushed)
+			continue
+		}
+
+		payload := buildPayload(&logEntry)
+		start := time.Now()
+		if err := q.retry.run(func() error { return q.send(&payload) }); err != nil {
+			q.retry.discard([]AccessLog{payload}, err)
+		} else {
+			q.retry.metrics.Forwarded(1, 0, time.Since(start))
+		}
+		logsHandled([]Log{logEntry})
+	}
+}
+
+func (q *SinkLogForwardingQueue) send(payload *AccessLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+
+	err := q.sink.Send(ctx, payload)
+	if err != nil {
+		log.Println("[WARNING][http-logging-middleware] Impossible to forward request log to sink:", err)
+	}
+	return err
+}
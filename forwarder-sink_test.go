@@ -0,0 +1,52 @@
+package ginhttplogger
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakySink struct {
+	failures int
+	entries  []AccessLog
+}
+
+func (s *flakySink) Send(ctx context.Context, entry *AccessLog) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+// Test that custom sinks receive complete access logs, and that failed sends are retried
+func TestSinkForwarder(t *testing.T) {
+	sink := &flakySink{failures: 2}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	accessLogger := NewAccessLogger(AccessLoggerConfig{Sink: sink, RetryInterval: time.Millisecond})
+	router.Use(accessLogger.Middleware())
+	router.DELETE("/users/:id", func(c *gin.Context) {
+		c.Status(404)
+	})
+
+	r, _ := http.NewRequest("DELETE", "/users/42", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, accessLogger.Shutdown(ctx))
+
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, "DELETE", sink.entries[0].Request.Method)
+	assert.Equal(t, "/users/42", sink.entries[0].Request.Path)
+	assert.Equal(t, 404, sink.entries[0].Response.Status)
+}
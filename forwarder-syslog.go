@@ -0,0 +1,209 @@
+package ginhttplogger
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogTimeout bounds connection and write delays
+const syslogTimeout = 10 * time.Second
+
+// syslogStructuredDataID is the SD-ID of the structured-data element of our messages, 32473 being
+// the private enterprise number reserved for documentation (RFC 5612)
+const syslogStructuredDataID = "access@32473"
+
+// syslogMaxUDPSize is the largest payload of a UDP datagram over IPv4, longer messages are
+// truncated (RFC 5426)
+const syslogMaxUDPSize = 65507
+
+// syslogSeverities maps log levels to syslog severities
+var syslogSeverities = map[logrus.Level]int{
+	logrus.ErrorLevel: 3,
+	logrus.WarnLevel:  4,
+	logrus.InfoLevel:  6,
+}
+
+// SyslogLogForwardingQueue sends logs as RFC 5424 syslog messages, over UDP, TCP or TLS
+type SyslogLogForwardingQueue struct {
+	Intake        chan Log
+	Address       string
+	transport     int
+	tlsConfig     *tls.Config
+	format        int
+	facility      int
+	appName       string
+	hostname      string
+	procID        string
+	batchSize     int
+	flushInterval time.Duration
+	streamSender
+}
+
+// NewSyslogLogForwardingQueue builds a log forwarding queue that sends entries to the syslog server
+// listening on Host:Port
+func NewSyslogLogForwardingQueue(conf AccessLoggerConfig) (q *SyslogLogForwardingQueue) {
+	q = &SyslogLogForwardingQueue{
+		Intake:        make(chan Log, conf.DropSize),
+		Address:       net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)),
+		transport:     conf.SyslogTransport,
+		tlsConfig:     conf.SyslogTLSConfig,
+		format:        conf.SyslogFormat,
+		facility:      conf.SyslogFacility,
+		appName:       syslogHeaderField(conf.SyslogAppName, 48),
+		hostname:      syslogHeaderField(conf.SyslogHostname, 255),
+		procID:        strconv.Itoa(os.Getpid()),
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+	}
+	q.streamSender = newStreamSender("syslog", "syslog", syslogTimeout, q.dial, conf)
+	return q
+}
+
+func (q *SyslogLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *SyslogLogForwardingQueue) run() {
+	// Forwards payloads asynchronously, by batches
+	batchLogs(q.Intake, q.batchSize, q.flushInterval, q.forward)
+	q.disconnect()
+}
+
+// forward sends a batch of logs
+func (q *SyslogLogForwardingQueue) forward(batch []Log) {
+	payloads := make([]AccessLog, 0, len(batch))
+	messages := make([][]byte, 0, len(batch))
+	for i := range batch {
+		payload := buildPayload(&batch[i])
+		message, err := q.message(&payload)
+		if err != nil {
+			log.Println("[ERROR][syslog-middleware] Failed to Marshal payload:", err)
+			q.retry.discard([]AccessLog{payload}, err)
+			continue
+		}
+		payloads = append(payloads, payload)
+		messages = append(messages, message)
+	}
+
+	deliver(&q.streamSender, payloads, messages, q.send)
+}
+
+// send writes messages on the wire and returns how many of them were sent. Stream transports frame
+// messages with their length (octet counting).
+func (q *SyslogLogForwardingQueue) send(messages [][]byte) (sent int, err error) {
+	for _, message := range messages {
+		if q.transport != SyslogTransportUDP {
+			message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+		}
+		if err := q.write(message); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (q *SyslogLogForwardingQueue) dial() (net.Conn, error) {
+	switch q.transport {
+	case SyslogTransportTCP:
+		return net.DialTimeout("tcp", q.Address, syslogTimeout)
+	case SyslogTransportTLS:
+		dialer := &net.Dialer{Timeout: syslogTimeout}
+		return tls.DialWithDialer(dialer, "tcp", q.Address, q.tlsConfig)
+	default:
+		return net.DialTimeout("udp", q.Address, syslogTimeout)
+	}
+}
+
+// message formats a log as an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+// Messages that wouldn't fit in a datagram are truncated when sent over UDP.
+func (q *SyslogLogForwardingQueue) message(payload *AccessLog) ([]byte, error) {
+	structuredData, body := "-", ""
+	if q.format == SyslogFormatStructuredData {
+		structuredData = syslogStructuredData(payload)
+		body = fmt.Sprintf("%s %s %d %d%s", payload.Request.Method, payload.Request.Path, payload.Response.Status, payload.Time, payload.TimeUnit)
+	} else {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = string(payloadBytes)
+	}
+
+	message := []byte(fmt.Sprintf("<%d>1 %s %s %s %s access %s %s",
+		q.facility*8+syslogSeverities[statusLevel(payload.Response.Status)],
+		payload.startDate.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		q.hostname, q.appName, q.procID,
+		structuredData, body,
+	))
+	if q.transport == SyslogTransportUDP && len(message) > syslogMaxUDPSize {
+		// Without cutting a character in half
+		end := syslogMaxUDPSize
+		for end > 0 && !utf8.RuneStart(message[end]) {
+			end--
+		}
+		message = message[:end]
+	}
+	return message, nil
+}
+
+// syslogStructuredData returns the structured-data element of a log, made of its main fields
+func syslogStructuredData(payload *AccessLog) string {
+	params := [][2]string{
+		{"method", payload.Request.Method},
+		{"path", payload.Request.Path},
+		{"route", payload.Request.Route},
+		{"query", payload.Request.Query},
+		{"status", strconv.Itoa(payload.Response.Status)},
+		{"duration", strconv.FormatInt(payload.Time, 10)},
+		{"duration_unit", payload.TimeUnit},
+		{"client_address", payload.ClientAddress},
+		{"request_size", strconv.FormatInt(payload.Request.Content.Size, 10)},
+		{"response_size", strconv.FormatInt(payload.Response.Content.Size, 10)},
+		{"request_id", payload.RequestID},
+		{"trace_id", payload.TraceID},
+		{"parent_span_id", payload.ParentSpanID},
+	}
+
+	var buf strings.Builder
+	buf.WriteString("[" + syslogStructuredDataID)
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		// '"', '\' and ']' have to be escaped in param values
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(param[1])
+		fmt.Fprintf(&buf, ` %s="%s"`, param[0], value)
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// syslogHeaderField makes a value fit in a header field of a message: printable ASCII characters
+// only, up to maxLength of them, "-" standing for empty values
+func syslogHeaderField(value string, maxLength int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
@@ -0,0 +1,219 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syslogMessage matches RFC 5424 messages: PRI, timestamp, hostname, app name, proc ID, structured
+// data and message
+var syslogMessage = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) access (-|\[.*?[^\\]\]) (.*)$`)
+
+// readOctetCounted reads messages framed with their length from a stream
+func readOctetCounted(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return
+		}
+		message := make([]byte, size)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			return
+		}
+		messages <- string(message)
+	}
+}
+
+// Test that logs are sent as RFC 5424 messages over UDP, with a JSON body and a severity that
+// follows the response status
+func TestSyslogForwarderUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	host, port := hostPort(conn.LocalAddr())
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:       ProtocolSyslog,
+		Host:           host,
+		Port:           port,
+		BatchSize:      2,
+		SyslogAppName:  "api",
+		SyslogHostname: "web 1",
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"))
+
+	buf := make([]byte, 65536)
+	for _, pri := range []string{"134", "132"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fields := syslogMessage.FindStringSubmatch(string(buf[:n]))
+		if assert.NotNil(t, fields, string(buf[:n])) {
+			// local0 (16) * 8 + info (6) or warning (4)
+			assert.Equal(t, pri, fields[1])
+			_, err := time.Parse(time.RFC3339Nano, fields[2])
+			assert.NoError(t, err)
+			assert.Equal(t, "web_1", fields[3])
+			assert.Equal(t, "api", fields[4])
+			assert.Equal(t, "-", fields[6])
+
+			var payload AccessLog
+			assert.NoError(t, json.Unmarshal([]byte(fields[7]), &payload))
+			assert.Contains(t, payload.Request.Path, "/users")
+		}
+	}
+}
+
+// Test that logs are sent over TCP, framed with their length, with the main fields of the logs as
+// structured data
+func TestSyslogForwarderTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	messages := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			readOctetCounted(conn, messages)
+		}
+	}()
+
+	host, port := hostPort(listener.Addr())
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:        ProtocolSyslog,
+		Host:            host,
+		Port:            port,
+		BatchSize:       2,
+		SyslogTransport: SyslogTransportTCP,
+		SyslogFormat:    SyslogFormatStructuredData,
+		SyslogFacility:  1,
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"))
+
+	fields := syslogMessage.FindStringSubmatch(<-messages)
+	if assert.NotNil(t, fields) {
+		assert.Equal(t, "14", fields[1])
+		assert.Regexp(t, `^\[access@32473 method="GET" path="/users/1" route="/users/:id" status="200" duration="\d+" duration_unit="us" request_size="0" response_size="5" request_id="[^"]+"\]$`, fields[6])
+		assert.Regexp(t, `^GET /users/1 200 \d+us$`, fields[7])
+	}
+	fields = syslogMessage.FindStringSubmatch(<-messages)
+	if assert.NotNil(t, fields) {
+		assert.Equal(t, "12", fields[1])
+		assert.Regexp(t, `^POST /users 400 \d+us$`, fields[7])
+	}
+}
+
+// Test that logs can be sent over TLS
+func TestSyslogForwarderTLS(t *testing.T) {
+	// Let's borrow the certificate of a test HTTPS server
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	messages := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			readOctetCounted(conn, messages)
+		}
+	}()
+
+	host, port := hostPort(listener.Addr())
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:        ProtocolSyslog,
+		Host:            host,
+		Port:            port,
+		BatchSize:       2,
+		SyslogTransport: SyslogTransportTLS,
+		SyslogTLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"))
+
+	assert.Regexp(t, syslogMessage, <-messages)
+	assert.Regexp(t, syslogMessage, <-messages)
+}
+
+// Test that the forwarder keeps reconnecting while the syslog server is unreachable
+func TestSyslogForwarderReconnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr()
+	listener.Close()
+
+	// The server only comes up once the first attempt failed
+	messages := make(chan string, 10)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener, err := net.Listen("tcp", address.String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err == nil {
+			readOctetCounted(conn, messages)
+		}
+	}()
+
+	host, port := hostPort(address)
+	serveRequests(t, AccessLoggerConfig{
+		Protocol:         ProtocolSyslog,
+		Host:             host,
+		Port:             port,
+		BatchSize:        2,
+		SyslogTransport:  SyslogTransportTCP,
+		RetryInterval:    20 * time.Millisecond,
+		RetryMaxAttempts: 50,
+	}, testRequest("GET", "/users/1"), testRequest("POST", "/users"))
+
+	assert.Regexp(t, syslogMessage, <-messages)
+	assert.Regexp(t, syslogMessage, <-messages)
+}
+
+// Test that values are escaped in structured data, and header fields sanitized
+func TestSyslogEscaping(t *testing.T) {
+	payload := AccessLog{Request: RequestLogEntry{Method: "GET", Path: `/a"b\c]d`}}
+	assert.Equal(t, `[access@32473 method="GET" path="/a\"b\\c\]d" status="0" duration="0" request_size="0" response_size="0"]`, syslogStructuredData(&payload))
+	assert.Equal(t, "-", syslogHeaderField("", 48))
+	assert.Equal(t, "caf_", syslogHeaderField("café", 48))
+	assert.Equal(t, "ab", syslogHeaderField("abc", 2))
+}
+
+// Test that messages too large for a datagram are truncated over UDP, without splitting characters,
+// and left alone over TCP
+func TestSyslogTruncation(t *testing.T) {
+	payload := AccessLog{Request: RequestLogEntry{Method: "GET", Path: "/" + strings.Repeat("é", syslogMaxUDPSize)}}
+
+	udp := NewSyslogLogForwardingQueue(AccessLoggerConfig{SyslogTransport: SyslogTransportUDP})
+	message, err := udp.message(&payload)
+	assert.NoError(t, err)
+	assert.True(t, len(message) <= syslogMaxUDPSize && len(message) > syslogMaxUDPSize-2)
+	assert.True(t, utf8.Valid(message))
+	assert.Regexp(t, syslogMessage, string(message[:200]))
+
+	tcp := NewSyslogLogForwardingQueue(AccessLoggerConfig{SyslogTransport: SyslogTransportTCP})
+	message, err = tcp.message(&payload)
+	assert.NoError(t, err)
+	assert.True(t, len(message) > 2*syslogMaxUDPSize)
+}
@@ -0,0 +1,80 @@
+package ginhttplogger
+
+import (
+	"context"
+	"net/http"
+)
+
+// contextKey is the type of the keys under which the net/http middleware stores the request ID and
+// trace context in the request's context
+type contextKey string
+
+// NewHTTPMiddleware returns a net/http middleware (compatible with chi and the like) that will log
+// our HTTP requests
+func NewHTTPMiddleware(conf AccessLoggerConfig) func(http.Handler) http.Handler {
+	return NewAccessLogger(conf).HTTPMiddleware()
+}
+
+// HTTPMiddleware returns the net/http middleware logging requests through this AccessLogger. It
+// logs the same records as the gin middleware, the route being given by AccessLoggerConfig.HTTPRoute,
+// the ServeMux pattern of the request by default (only known before the handler runs, for rules,
+// when the middleware wraps handlers registered on the ServeMux rather than the ServeMux itself).
+func (a *AccessLogger) HTTPMiddleware() func(http.Handler) http.Handler {
+	return buildHTTPLoggingMiddleware(a.conf, a)
+}
+
+func buildHTTPLoggingMiddleware(conf AccessLoggerConfig, logger *AccessLogger) func(http.Handler) http.Handler {
+	core := newLoggingCore(conf, logger)
+	route := conf.HTTPRoute
+	if route == nil {
+		route = func(r *http.Request) string { return r.Pattern }
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e := core.begin(r, route(r), w.Header())
+			if e == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// We need the status and size of the response anyway, its body only when it's logged
+			var responseBodyLeech *LeechedResponseWriter
+			if e.captureSize > 0 {
+				responseBodyLeech = NewLeechedResponseWriter(w, e.captureSize, conf.MaxBodyLogTailSize)
+				e.responseCapture = &responseBodyLeech.bodyCapture
+			} else {
+				responseBodyLeech = NewLeechedResponseWriter(w, 0, 0)
+			}
+
+			ctx := r.Context()
+			if e.requestID != "" {
+				ctx = context.WithValue(ctx, contextKey(ContextKeyRequestID), e.requestID)
+			}
+			if e.trace.traceID != "" {
+				ctx = context.WithValue(ctx, contextKey(ContextKeyTraceID), e.trace.traceID)
+				ctx = context.WithValue(ctx, contextKey(ContextKeyParentSpanID), e.trace.parentSpanID)
+				ctx = context.WithValue(ctx, contextKey(ContextKeyTraceState), e.trace.traceState)
+			}
+			r = r.WithContext(ctx)
+
+			// Let's process the request
+			next.ServeHTTP(responseBodyLeech, r)
+
+			e.end(r, handledResponse{
+				route:    route(r),
+				clientIP: clientIP(r),
+				status:   responseBodyLeech.Status(),
+				size:     int(responseBodyLeech.Size()),
+				header:   w.Header(),
+			})
+		})
+	}
+}
+
+// ContextValue returns the request ID or trace context value stored under one of the ContextKey*
+// keys by the net/http middleware, gin handlers can use c.GetString() instead
+func ContextValue(ctx context.Context, key string) string {
+	value, _ := ctx.Value(contextKey(key)).(string)
+	return value
+}
@@ -0,0 +1,181 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends the same request to server and returns the log it produced, without its timings
+func logOf(t *testing.T, logQueue *MockedLogForwardingQueue, handler http.Handler) AccessLog {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	r, _ := http.NewRequest("POST", server.URL+"/echo?password=hunter2&x=1", bytes.NewBufferString(`{"password": "hunter2", "name": "bob"}`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("X-Request-ID", "my-request")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res, err := server.Client().Do(r)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, `{"password": "hunter2", "name": "bob"}`, string(body))
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	payload.TimeStarted, payload.TimeEnded, payload.Time, payload.startDate, payload.latency = "", "", 0, time.Time{}, 0
+	return payload
+}
+
+// Test that the gin and net/http middlewares log identical records
+func TestHTTPMiddlewareMatchesGin(t *testing.T) {
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:   LogAllBodies,
+		MaxBodyLogSize:  1000,
+		DropSize:        10,
+		RequestIDHeader: "X-Request-ID",
+	}
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write(body)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	ginQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, ginQueue)))
+	go ginQueue.run()
+	router.POST("/echo", func(c *gin.Context) {
+		echo(c.Writer, c.Request)
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", echo)
+	httpQueue := NewMockedLogForwardingQueue(conf)
+	handler := buildHTTPLoggingMiddleware(conf, newAccessLogger(conf, httpQueue))(mux)
+	go httpQueue.run()
+
+	ginLog := logOf(t, ginQueue, router)
+	httpLog := logOf(t, httpQueue, handler)
+	assert.Equal(t, ginLog, httpLog)
+
+	// Let's make sure we didn't compare empty records
+	assert.Equal(t, "/echo", httpLog.Request.Route)
+	assert.Equal(t, "10.0.0.1", httpLog.ClientAddress)
+	assert.Equal(t, "my-request", httpLog.RequestID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", httpLog.TraceID)
+	assert.Equal(t, 201, httpLog.Response.Status)
+	assert.Equal(t, `{"password":"[REDACTED]","name":"bob"}`, httpLog.Request.Content.Content)
+	assert.Equal(t, `{"password":"[REDACTED]","name":"bob"}`, httpLog.Response.Content.Content)
+}
+
+// Test that handlers behind the net/http middleware get their context, and can still flush and
+// hijack the connection
+func TestHTTPMiddleware(t *testing.T) {
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:   LogAllBodies,
+		MaxBodyLogSize:  1000,
+		DropSize:        10,
+		RequestIDHeader: "X-Request-ID",
+		Rules:           []LogRule{{Routes: []string{"GET /health"}, Skip: true}},
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	middleware := buildHTTPLoggingMiddleware(conf, newAccessLogger(conf, logQueue))
+	go logQueue.run()
+
+	var requestID string
+	mux := http.NewServeMux()
+	mux.Handle("GET /health", middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	mux.Handle("GET /stream", middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = ContextValue(r.Context(), ContextKeyRequestID)
+		io.WriteString(w, "first ")
+		assert.NoError(t, http.NewResponseController(w).Flush())
+		io.WriteString(w, "second")
+	})))
+	mux.Handle("GET /hijack", middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) string {
+		res, err := server.Client().Get(server.URL + path)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, "hijacked", get("/hijack"))
+	assert.Equal(t, "ok", get("/health"))
+	assert.Equal(t, "first second", get("/stream"))
+
+	// Hijacked connections are logged, health checks aren't, the mocked queue only keeps the first log
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, "GET /hijack", payload.Request.Route)
+
+	assert.NotEmpty(t, requestID)
+}
+
+// Test that routes can be read from the request by HTTPRoute, for routers that don't set its
+// pattern, and that responses whose bodies aren't logged aren't captured
+func TestHTTPMiddlewareRoute(t *testing.T) {
+	type routeKey struct{}
+	conf := AccessLoggerConfig{
+		MaxBodyLogTailSize: 100,
+		DropSize:           10,
+		HTTPRoute: func(r *http.Request) string {
+			route, _ := r.Context().Value(routeKey{}).(*string)
+			if route == nil {
+				return ""
+			}
+			return *route
+		},
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	middleware := buildHTTPLoggingMiddleware(conf, newAccessLogger(conf, logQueue))
+	go logQueue.run()
+
+	// Like chi's, our router only knows the route once it has routed the request
+	router := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, new(string))))
+		})
+	}
+	handler := router(middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*r.Context().Value(routeKey{}).(*string) = "/users/{id}"
+		leech := w.(*LeechedResponseWriter)
+		assert.Zero(t, leech.headSize)
+		assert.Zero(t, leech.tailSize)
+		io.Copy(w, strings.NewReader("hello"))
+	})))
+
+	r := httptest.NewRequest("GET", "/users/1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, "/users/{id}", payload.Request.Route)
+	assert.Equal(t, int64(5), payload.Response.Content.Size)
+}
@@ -1,34 +1,50 @@
 package ginhttplogger
 
-import "github.com/gin-gonic/gin"
+import (
+	"io"
 
-// LeechedGinResponseWriter is an extension of gin.ResponseWriter that logs the first bytes of the
-// response body in a bytes buffer
+	"github.com/gin-gonic/gin"
+)
+
+// LeechedGinResponseWriter is an extension of gin.ResponseWriter that logs the first (and optionally
+// the last) bytes of the response body in a bytes buffer. Hijack, Flush, CloseNotify and Pusher are
+// left to the original writer.
 type LeechedGinResponseWriter struct {
 	gin.ResponseWriter
-
-	data             []byte
-	maxBodyLogSize   int64
-	loggedBytesCount int64
+	bodyCapture
 }
 
 // NewLeechedGinResponseWriter builds an returns a LeechedGinResponseWriter
 func NewLeechedGinResponseWriter(source gin.ResponseWriter, maxSize int64) (newWriter *LeechedGinResponseWriter) {
+	return NewHeadTailLeechedGinResponseWriter(source, maxSize, 0)
+}
+
+// NewHeadTailLeechedGinResponseWriter does the same as NewLeechedGinResponseWriter, but also keeps
+// the last tailSize bytes of the body
+func NewHeadTailLeechedGinResponseWriter(source gin.ResponseWriter, headSize, tailSize int64) *LeechedGinResponseWriter {
 	return &LeechedGinResponseWriter{
-		data:           make([]byte, 0, maxSize),
-		maxBodyLogSize: maxSize,
 		ResponseWriter: source,
+		bodyCapture:    newBodyCapture(headSize, tailSize),
 	}
 }
 
 // Write stores up to maxSize bites that go through the original writer while writing them on the
 // orginal writer
 func (l *LeechedGinResponseWriter) Write(b []byte) (int, error) {
-	spaceLeft := l.maxBodyLogSize - l.loggedBytesCount
-	if spaceLeft > 0 {
-		l.data = append(l.data, b[:min(spaceLeft, int64(len(b)))]...)
-		l.loggedBytesCount += int64(len(b))
-	}
-
+	capture(&l.bodyCapture, b)
 	return l.ResponseWriter.Write(b)
 }
+
+// WriteString does the same as Write for strings, it's used by io.WriteString() and some of gin's
+// renderers
+func (l *LeechedGinResponseWriter) WriteString(s string) (int, error) {
+	capture(&l.bodyCapture, s)
+	return l.ResponseWriter.WriteString(s)
+}
+
+// ReadFrom implements io.ReaderFrom, which io.Copy() uses when serving files and readers, without
+// preventing the original writer from using sendfile and the like
+func (l *LeechedGinResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, _, err := l.readFrom(l, l.ResponseWriter, r)
+	return n, err
+}
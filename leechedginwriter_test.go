@@ -0,0 +1,190 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/testdata/protoexample"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// Serves a single request to handler through the logging middleware over a real connection, and
+// returns the body received by the client along with the log entry
+func serveLeeched(t *testing.T, start func(*httptest.Server), maxBodyLogSize int64, setup func(*gin.Engine), handler gin.HandlerFunc) (body []byte, logEntry Log) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if setup != nil {
+		setup(router)
+	}
+
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:  LogAllBodies,
+		MaxBodyLogSize: maxBodyLogSize,
+		DropSize:       10,
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	router.GET("/render", func(c *gin.Context) {
+		_, leeched := c.Writer.(*LeechedGinResponseWriter)
+		assert.True(t, leeched, "the response writer should be leeched")
+		handler(c)
+	})
+
+	server := httptest.NewUnstartedServer(router)
+	start(server)
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	res, err := client.Get(server.URL + "/render")
+	if !assert.NoError(t, err) {
+		return nil, Log{}
+	}
+	body, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+
+	return body, logQueue.pop()
+}
+
+// Test that bodies are captured whatever the write path gin's renderers use
+func TestLeechedGinResponseWriterRenders(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	assert.NoError(t, os.WriteFile(filePath, []byte("some file content"), 0o644))
+
+	protoLabel := "protobuf"
+	protoBody, err := proto.Marshal(&protoexample.Test{Label: &protoLabel, Reps: []int64{1, 2}})
+	assert.NoError(t, err)
+
+	object := gin.H{"html": "<b>", "text": "héllo"}
+	renders := []struct {
+		name    string
+		setup   func(*gin.Engine)
+		handler gin.HandlerFunc
+	}{
+		{"String", nil, func(c *gin.Context) { c.String(200, "hello") }},
+		{"StringFormat", nil, func(c *gin.Context) { c.String(200, "hello %s", "world") }},
+		{"JSON", nil, func(c *gin.Context) { c.JSON(200, object) }},
+		{"IndentedJSON", nil, func(c *gin.Context) { c.IndentedJSON(200, object) }},
+		{"SecureJSON", nil, func(c *gin.Context) { c.SecureJSON(200, []string{"a", "b"}) }},
+		{"JSONP", nil, func(c *gin.Context) {
+			c.Request.URL.RawQuery = "callback=cb"
+			c.JSONP(200, object)
+		}},
+		{"AsciiJSON", nil, func(c *gin.Context) { c.AsciiJSON(200, object) }},
+		{"PureJSON", nil, func(c *gin.Context) { c.PureJSON(200, object) }},
+		{"XML", nil, func(c *gin.Context) { c.XML(200, gin.H{"text": "hello"}) }},
+		{"YAML", nil, func(c *gin.Context) { c.YAML(200, object) }},
+		{"TOML", nil, func(c *gin.Context) { c.TOML(200, object) }},
+		{"ProtoBuf", nil, func(c *gin.Context) {
+			c.ProtoBuf(200, &protoexample.Test{Label: &protoLabel, Reps: []int64{1, 2}})
+		}},
+		{"HTML", func(router *gin.Engine) {
+			router.SetHTMLTemplate(template.Must(template.New("page").Parse("<p>{{.}}</p>")))
+		}, func(c *gin.Context) { c.HTML(200, "page", "hello") }},
+		{"Data", nil, func(c *gin.Context) { c.Data(200, "application/octet-stream", protoBody) }},
+		{"DataFromReader", nil, func(c *gin.Context) {
+			c.DataFromReader(200, 11, "text/plain", strings.NewReader("from reader"), nil)
+		}},
+		{"File", nil, func(c *gin.Context) { c.File(filePath) }},
+		{"FileFromFS", nil, func(c *gin.Context) { c.FileFromFS("file.txt", http.Dir(dir)) }},
+		{"Redirect", nil, func(c *gin.Context) { c.Redirect(http.StatusFound, "/elsewhere") }},
+		{"SSEvent", nil, func(c *gin.Context) { c.SSEvent("message", "hello") }},
+		{"Stream", nil, func(c *gin.Context) {
+			chunks := []string{"one", "two", "three"}
+			c.Stream(func(w io.Writer) bool {
+				io.WriteString(w, chunks[0])
+				chunks = chunks[1:]
+				return len(chunks) > 0
+			})
+		}},
+		{"CopyFromReader", nil, func(c *gin.Context) {
+			io.Copy(c.Writer, io.MultiReader(strings.NewReader("copied "), bytes.NewBufferString("body")))
+		}},
+	}
+
+	for _, render := range renders {
+		t.Run(render.name, func(t *testing.T) {
+			body, logEntry := serveLeeched(t, (*httptest.Server).Start, 4096, render.setup, render.handler)
+			assert.NotEmpty(t, body)
+			assert.Equal(t, string(body), logEntry.responseBody)
+		})
+	}
+}
+
+// Test that only the first bytes of large bodies copied through ReadFrom get logged, and that the
+// client still gets the whole body
+func TestLeechedGinResponseWriterReadFromTruncation(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	filePath := filepath.Join(t.TempDir(), "large.txt")
+	assert.NoError(t, os.WriteFile(filePath, content, 0o644))
+
+	body, logEntry := serveLeeched(t, (*httptest.Server).Start, 1000, nil, func(c *gin.Context) {
+		c.File(filePath)
+	})
+	assert.Equal(t, content, body)
+	assert.Equal(t, string(content[:1000]), logEntry.responseBody)
+	assert.Equal(t, int64(len(content)), logEntry.responseContentLength)
+}
+
+// Test that the optional interfaces of the original writer are still reachable through the leech
+func TestLeechedGinResponseWriterInterfaces(t *testing.T) {
+	t.Run("Hijack", func(t *testing.T) {
+		body, _ := serveLeeched(t, (*httptest.Server).Start, 4096, nil, func(c *gin.Context) {
+			conn, rw, err := c.Writer.Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			rw.Flush()
+		})
+		assert.Equal(t, "hijacked", string(body))
+	})
+
+	t.Run("FlushAndCloseNotify", func(t *testing.T) {
+		body, logEntry := serveLeeched(t, (*httptest.Server).Start, 4096, nil, func(c *gin.Context) {
+			assert.NotNil(t, c.Writer.CloseNotify())
+			c.Writer.WriteString("flushed")
+			c.Writer.Flush()
+			assert.True(t, c.Writer.Written())
+		})
+		assert.Equal(t, "flushed", string(body))
+		assert.Equal(t, "flushed", logEntry.responseBody)
+	})
+
+	t.Run("Pusher", func(t *testing.T) {
+		var pusher http.Pusher
+		serveLeeched(t, (*httptest.Server).Start, 4096, nil, func(c *gin.Context) {
+			pusher = c.Writer.Pusher()
+			c.String(200, "not pushed")
+		})
+		assert.Nil(t, pusher, "HTTP/1 connections shouldn't expose a pusher")
+
+		startHTTP2 := func(server *httptest.Server) {
+			server.EnableHTTP2 = true
+			server.StartTLS()
+		}
+		body, logEntry := serveLeeched(t, startHTTP2, 4096, nil, func(c *gin.Context) {
+			pusher = c.Writer.Pusher()
+			c.String(200, "pushed")
+		})
+		assert.NotNil(t, pusher, "HTTP/2 connections should expose a pusher")
+		assert.Equal(t, "pushed", string(body))
+		assert.Equal(t, "pushed", logEntry.responseBody)
+	})
+}
@@ -0,0 +1,114 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// LeechedResponseWriter is the net/http counterpart of LeechedGinResponseWriter: it logs the first
+// (and optionally the last) bytes of the response body, and keeps track of the status and size of
+// the response. Flush, Hijack and Push are forwarded to the original writer when it supports them,
+// Unwrap gives http.ResponseController access to it.
+type LeechedResponseWriter struct {
+	http.ResponseWriter
+	bodyCapture
+
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+// NewLeechedResponseWriter builds an returns a LeechedResponseWriter, headSize and tailSize may be
+// 0 to only keep track of the status and size of the response
+func NewLeechedResponseWriter(source http.ResponseWriter, headSize, tailSize int64) *LeechedResponseWriter {
+	return &LeechedResponseWriter{
+		ResponseWriter: source,
+		bodyCapture:    newBodyCapture(headSize, tailSize),
+		status:         http.StatusOK,
+	}
+}
+
+// Status returns the status code of the response
+func (l *LeechedResponseWriter) Status() int {
+	return l.status
+}
+
+// Size returns the number of bytes written in the response body
+func (l *LeechedResponseWriter) Size() int64 {
+	return l.size
+}
+
+// WriteHeader records the status code of the response, informational (1xx) headers aside
+func (l *LeechedResponseWriter) WriteHeader(code int) {
+	if !l.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		l.status = code
+		l.wroteHeader = true
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+// Write stores up to maxSize bites that go through the original writer while writing them on the
+// orginal writer
+func (l *LeechedResponseWriter) Write(b []byte) (int, error) {
+	l.wroteHeader = true
+	capture(&l.bodyCapture, b)
+	n, err := l.ResponseWriter.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// WriteString does the same as Write for strings
+func (l *LeechedResponseWriter) WriteString(s string) (n int, err error) {
+	l.wroteHeader = true
+	capture(&l.bodyCapture, s)
+	if stringWriter, ok := l.ResponseWriter.(io.StringWriter); ok {
+		n, err = stringWriter.WriteString(s)
+	} else {
+		n, err = l.ResponseWriter.Write([]byte(s))
+	}
+	l.size += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, which io.Copy() uses when serving files and readers, without
+// preventing the original writer from using sendfile and the like. Bytes written directly by the
+// original writer are counted in the size of the response.
+func (l *LeechedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, direct, err := l.readFrom(l, l.ResponseWriter, r)
+	if direct > 0 {
+		l.wroteHeader = true
+	}
+	l.size += direct
+	return n, err
+}
+
+// Flush sends buffered data to the client, if the original writer supports it
+func (l *LeechedResponseWriter) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		l.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, if the original writer supports it
+func (l *LeechedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := l.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Push initiates an HTTP/2 server push, if the original writer supports it
+func (l *LeechedResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := l.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the original writer, for http.ResponseController
+func (l *LeechedResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
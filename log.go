@@ -3,32 +3,69 @@ package ginhttplogger
 import (
 	"net/http"
 	"time"
-
-	"github.com/gin-gonic/gin"
 )
 
 // Log structure passed through the log forwarding channel
 type Log struct {
-	context               *gin.Context
+	request               *http.Request
+	route                 string
+	clientIP              string
+	status                int
+	errors                string
 	startDate             time.Time
 	latency               time.Duration
 	requestBody           string
+	requestBodyTail       string
+	requestBodyOmitted    int64
+	requestContentLength  int64
 	responseHeaders       http.Header
 	responseBody          string
+	responseBodyTail      string
+	responseBodyOmitted   int64
 	responseContentLength int64
+	bodyLogSize           int64
+	formatting            *formattingOptions
+	requestID             string
+	trace                 traceContext
+	sampledOut            int64
+
+	// payload is only set on logs replayed from the disk spool, which were formatted before being
+	// written to disk
+	payload *AccessLog
+
+	// handled is only set on logs replayed from the disk spool, which are only consumed from it once
+	// forwarders are done with them: delivered, or handed to the dead letter callback
+	handled func()
+
+	// flushed is only set on the markers sent through the queue by AccessLogger.Flush(), forwarders
+	// close it once every log received before the marker has been forwarded
+	flushed chan struct{}
 }
 
-// HTTPContent describes the format of a Request body and it's metadata
+// HTTPContent describes the format of a Request body and it's metadata. Bodies larger than what we
+// log are Truncated: OmittedBytes bytes were left out between the beginning of the body (Content)
+// and its end (Tail, when MaxBodyLogTailSize is set). OmittedBytes counts bytes as they were sent,
+// compressed ones for bodies that were decompressed. Encoding tells whether Content and Tail are
+// text, base64 or the SHA-256 of the captured bytes, DecodedFrom the Content-Encoding of bodies that
+// were decompressed before being logged.
 type HTTPContent struct {
-	Size     int64  `json:"size"`
-	MimeType string `json:"mime_type,omitempty"`
-	Content  string `json:"value,omitempty"`
+	Size         int64  `json:"size"`
+	MimeType     string `json:"mime_type,omitempty"`
+	DecodedFrom  string `json:"decoded_from,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+	Content      string `json:"value,omitempty"`
+	Tail         string `json:"tail,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+	OmittedBytes int64  `json:"omitted_bytes,omitempty"`
 }
 
 // RequestLogEntry describes the incoming requests log format
 type RequestLogEntry struct {
 	Method      string            `json:"method"`
 	Path        string            `json:"path"`
+	Route       string            `json:"route,omitempty"`
+	Query       string            `json:"query,omitempty"`
+	QueryParams map[string]string `json:"query_params,omitempty"`
 	HTTPVersion string            `json:"http_version"`
 	Headers     map[string]string `json:"headers"`
 	HeaderSize  int               `json:"headers_size"`
@@ -46,9 +83,26 @@ type ResponseLogEntry struct {
 // AccessLog describes the complete log entry format
 type AccessLog struct {
 	TimeStarted   string           `json:"start_time"`
+	TimeEnded     string           `json:"end_time"`
+	StartMillis   int64            `json:"start_epoch_ms,omitempty"`
+	EndMillis     int64            `json:"end_epoch_ms,omitempty"`
+	StartNanos    int64            `json:"start_epoch_ns,omitempty"`
+	EndNanos      int64            `json:"end_epoch_ns,omitempty"`
 	ClientAddress string           `json:"x_client_address,omitempty"`
+	RequestID     string           `json:"request_id,omitempty"`
+	TraceID       string           `json:"trace_id,omitempty"`
+	ParentSpanID  string           `json:"parent_span_id,omitempty"`
+	SampledOut    int64            `json:"sampled_out,omitempty"`
 	Time          int64            `json:"duration"`
+	TimeUnit      string           `json:"duration_unit"`
 	Request       RequestLogEntry  `json:"request"`
 	Response      ResponseLogEntry `json:"response"`
 	Errors        string           `json:"errors,omitempty"`
+
+	// startDate is kept along the formatted log so that it can be spooled to disk with its timestamp,
+	// and so are the exact duration of the request and its user agent, whatever the duration unit
+	// and header policies, for the forwarders that need them
+	startDate time.Time
+	latency   time.Duration
+	userAgent string
 }
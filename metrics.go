@@ -0,0 +1,181 @@
+package ginhttplogger
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics is notified of what happens in the logging pipeline, implement it to plug the middleware
+// into your own monitoring system, or use ExpvarMetrics. Methods are called concurrently.
+type Metrics interface {
+	// Enqueued is called for every log passed to the forwarding queue
+	Enqueued()
+	// Dropped is called for every log that couldn't be queued (nor spooled)
+	Dropped()
+	// QueueDepth is called with the number of logs waiting in the queue, whenever logs are queued
+	QueueDepth(depth int)
+	// Forwarded is called when logs have been delivered, with the size of the payload sent to the
+	// backend (0 when unknown) and the time it took, retries included
+	Forwarded(count int, bytes int, latency time.Duration)
+	// Retried is called when a delivery attempt failed and is about to be retried
+	Retried()
+	// Failed is called with the number of logs the retry policy gave up on
+	Failed(count int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Enqueued()                         {}
+func (noopMetrics) Dropped()                          {}
+func (noopMetrics) QueueDepth(int)                    {}
+func (noopMetrics) Forwarded(int, int, time.Duration) {}
+func (noopMetrics) Retried()                          {}
+func (noopMetrics) Failed(int)                        {}
+
+// queueDepthSampler is implemented by Metrics that read the depth of the queue whenever they're
+// collected, rather than relying on the last value passed to QueueDepth which gets stale as the
+// forwarder drains the queue
+type queueDepthSampler interface {
+	sampleQueueDepth(depth func() int)
+}
+
+// pipelineMetrics returns the configured Metrics, or an implementation doing nothing
+func pipelineMetrics(conf AccessLoggerConfig) Metrics {
+	if conf.Metrics == nil {
+		return noopMetrics{}
+	}
+	return conf.Metrics
+}
+
+// ExpvarMetrics keeps pipeline metrics in an expvar.Map, they can also be exposed in the Prometheus
+// text format with PrometheusHandler
+type ExpvarMetrics struct {
+	vars       *expvar.Map
+	queueDepth *expvar.Int
+
+	// queues are sampled when metrics are read, the depth of the queues of every AccessLogger using
+	// these metrics is reported
+	mutex  sync.Mutex
+	queues []func() int
+}
+
+// NewExpvarMetrics creates an ExpvarMetrics, published under name (on /debug/vars) unless name is
+// empty. Like expvar.Publish, it panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		vars:       new(expvar.Map).Init(),
+		queueDepth: new(expvar.Int),
+	}
+	m.vars.Set("queue_depth", expvar.Func(func() interface{} { return m.currentQueueDepth() }))
+	for _, counter := range []string{"enqueued", "dropped", "forwarded", "retried", "failed", "payload_bytes", "forwarding_latency_count"} {
+		m.vars.Add(counter, 0)
+	}
+	m.vars.AddFloat("forwarding_latency_seconds", 0)
+
+	if name != "" {
+		expvar.Publish(name, m.vars)
+	}
+	return m
+}
+
+// Vars returns the expvar.Map holding the metrics
+func (m *ExpvarMetrics) Vars() *expvar.Map {
+	return m.vars
+}
+
+// Enqueued implements Metrics
+func (m *ExpvarMetrics) Enqueued() {
+	m.vars.Add("enqueued", 1)
+}
+
+// Dropped implements Metrics
+func (m *ExpvarMetrics) Dropped() {
+	m.vars.Add("dropped", 1)
+}
+
+// QueueDepth implements Metrics
+func (m *ExpvarMetrics) QueueDepth(depth int) {
+	m.queueDepth.Set(int64(depth))
+}
+
+func (m *ExpvarMetrics) sampleQueueDepth(depth func() int) {
+	m.mutex.Lock()
+	m.queues = append(m.queues, depth)
+	m.mutex.Unlock()
+}
+
+// currentQueueDepth returns the number of logs waiting in the sampled queues, or the last value
+// passed to QueueDepth if there's none
+func (m *ExpvarMetrics) currentQueueDepth() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.queues) == 0 {
+		return m.queueDepth.Value()
+	}
+	var depth int64
+	for _, queue := range m.queues {
+		depth += int64(queue())
+	}
+	return depth
+}
+
+// Forwarded implements Metrics
+func (m *ExpvarMetrics) Forwarded(count int, bytes int, latency time.Duration) {
+	m.vars.Add("forwarded", int64(count))
+	m.vars.Add("payload_bytes", int64(bytes))
+	m.vars.Add("forwarding_latency_count", 1)
+	m.vars.AddFloat("forwarding_latency_seconds", latency.Seconds())
+}
+
+// Retried implements Metrics
+func (m *ExpvarMetrics) Retried() {
+	m.vars.Add("retried", 1)
+}
+
+// Failed implements Metrics
+func (m *ExpvarMetrics) Failed(count int) {
+	m.vars.Add("failed", int64(count))
+}
+
+// expvarCounters maps our expvar counters to Prometheus metric names and help strings
+var expvarCounters = [][3]string{
+	{"enqueued", "ginhttplogger_logs_enqueued_total", "Access logs passed to the forwarding queue."},
+	{"dropped", "ginhttplogger_logs_dropped_total", "Access logs dropped because the forwarding queue was full."},
+	{"forwarded", "ginhttplogger_logs_forwarded_total", "Access logs delivered to the backend."},
+	{"retried", "ginhttplogger_delivery_retries_total", "Delivery attempts that failed and were retried."},
+	{"failed", "ginhttplogger_logs_failed_total", "Access logs given up on by the retry policy."},
+	{"payload_bytes", "ginhttplogger_payload_bytes_total", "Bytes sent to the backend."},
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (m *ExpvarMetrics) WritePrometheus(w io.Writer) {
+	for _, counter := range expvarCounters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", counter[1], counter[2], counter[1], counter[1], m.vars.Get(counter[0]))
+	}
+
+	fmt.Fprintln(w, "# HELP ginhttplogger_queue_depth Access logs waiting in the forwarding queue.")
+	fmt.Fprintln(w, "# TYPE ginhttplogger_queue_depth gauge")
+	fmt.Fprintln(w, "ginhttplogger_queue_depth", m.currentQueueDepth())
+
+	fmt.Fprintln(w, "# HELP ginhttplogger_forwarding_latency_seconds Time spent delivering access logs, retries included.")
+	fmt.Fprintln(w, "# TYPE ginhttplogger_forwarding_latency_seconds summary")
+	fmt.Fprintln(w, "ginhttplogger_forwarding_latency_seconds_sum", m.vars.Get("forwarding_latency_seconds"))
+	fmt.Fprintln(w, "ginhttplogger_forwarding_latency_seconds_count", m.vars.Get("forwarding_latency_count"))
+}
+
+// PrometheusHandler serves metrics in the Prometheus text exposition format, it can be mounted on
+// any gin route: router.GET("/metrics", httpLogger.PrometheusHandler(metrics, redMetrics))
+func PrometheusHandler(collectors ...PrometheusCollector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(200)
+		for _, collector := range collectors {
+			collector.WritePrometheus(c.Writer)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ginhttplogger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that pipeline metrics are collected and exposed in the Prometheus format
+func TestExpvarMetrics(t *testing.T) {
+	metrics := NewExpvarMetrics("")
+	sink := &flakySink{failures: 1}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	accessLogger := NewAccessLogger(AccessLoggerConfig{
+		Sink:          sink,
+		Metrics:       metrics,
+		RetryInterval: time.Millisecond,
+	})
+	router.Use(accessLogger.Middleware())
+	router.GET("/ping", func(c *gin.Context) {})
+	router.GET("/metrics", PrometheusHandler(metrics))
+
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, accessLogger.Flush(ctx))
+
+	assert.Equal(t, "1", metrics.Vars().Get("enqueued").String())
+	assert.Equal(t, "1", metrics.Vars().Get("forwarded").String())
+	assert.Equal(t, "1", metrics.Vars().Get("retried").String())
+	// The queue has been drained since the log was queued
+	assert.Equal(t, "0", metrics.Vars().Get("queue_depth").String())
+
+	w := httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, r)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE ginhttplogger_logs_forwarded_total counter\nginhttplogger_logs_forwarded_total 1\n")
+	assert.Contains(t, w.Body.String(), "ginhttplogger_forwarding_latency_seconds_count 1\n")
+	assert.Contains(t, w.Body.String(), "ginhttplogger_queue_depth 0\n")
+}
@@ -1,7 +1,10 @@
 package ginhttplogger
 
 import (
+	"crypto/tls"
 	"log"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,6 +21,81 @@ const (
 	LogAllBodies
 )
 
+const (
+	// HTTPBatchJSONArray posts batches of logs as a single JSON array
+	HTTPBatchJSONArray = 1 + iota
+	// HTTPBatchNDJSON posts batches of logs as newline-delimited JSON objects
+	HTTPBatchNDJSON
+)
+
+const (
+	// SpoolSyncPeriodic syncs the spool to disk every SpoolSyncInterval
+	SpoolSyncPeriodic = 1 + iota
+	// SpoolSyncAlways syncs the spool to disk after every write, safest but slowest
+	SpoolSyncAlways
+	// SpoolSyncNever leaves it up to the OS to write the spool to disk
+	SpoolSyncNever
+)
+
+const (
+	// ProtocolHTTP posts logs, as JSON, to an HTTP endpoint such as Fluentd's in_http
+	ProtocolHTTP = 1 + iota
+	// ProtocolFluentdForward sends logs using Fluentd's msgpack-based forward protocol over TCP
+	ProtocolFluentdForward
+	// ProtocolElasticsearch indexes logs in Elasticsearch or OpenSearch through the _bulk API
+	ProtocolElasticsearch
+	// ProtocolLoki pushes logs to Grafana Loki
+	ProtocolLoki
+	// ProtocolOTLP exports logs to an OpenTelemetry collector over OTLP/HTTP
+	ProtocolOTLP
+	// ProtocolSyslog sends logs as RFC 5424 syslog messages
+	ProtocolSyslog
+	// ProtocolGELF sends logs to Graylog as GELF messages
+	ProtocolGELF
+)
+
+const (
+	// FluentdModeMessage sends each log in its own message
+	FluentdModeMessage = 1 + iota
+	// FluentdModeForward sends batches of logs as an array of entries
+	FluentdModeForward
+	// FluentdModePackedForward sends batches of logs as a single binary stream of entries
+	FluentdModePackedForward
+)
+
+const (
+	// SyslogTransportUDP sends each syslog message in its own datagram
+	SyslogTransportUDP = 1 + iota
+	// SyslogTransportTCP sends syslog messages over TCP, with octet-counting framing (RFC 6587)
+	SyslogTransportTCP
+	// SyslogTransportTLS sends syslog messages over TLS, with octet-counting framing (RFC 5425)
+	SyslogTransportTLS
+)
+
+const (
+	// SyslogFormatJSON logs the whole log, as JSON, in the message body
+	SyslogFormatJSON = 1 + iota
+	// SyslogFormatStructuredData logs the main fields of the log as an RFC 5424 structured-data
+	// element, along with a short summary of the request as the message body
+	SyslogFormatStructuredData
+)
+
+const (
+	// GELFTransportUDP sends each GELF message in its own datagram, or chunks if it doesn't fit
+	GELFTransportUDP = 1 + iota
+	// GELFTransportTCP sends GELF messages over TCP, terminated by a null byte
+	GELFTransportTCP
+)
+
+const (
+	// GELFCompressionGzip compresses GELF messages sent over UDP with gzip
+	GELFCompressionGzip = 1 + iota
+	// GELFCompressionZlib compresses GELF messages sent over UDP with zlib
+	GELFCompressionZlib
+	// GELFCompressionNone sends GELF messages uncompressed
+	GELFCompressionNone
+)
+
 // NoBodyHTTPMethods is the list of methods for which we don't log bodies cause they don't have any
 var NoBodyHTTPMethods = map[string]struct{}{
 	"HEAD":    struct{}{},
@@ -27,7 +105,10 @@ var NoBodyHTTPMethods = map[string]struct{}{
 
 // AccessLoggerConfig describe the config of our access logger
 type AccessLoggerConfig struct {
+	Sink           LogSink
+	SinkTimeout    time.Duration
 	LogrusLogger   *logrus.Logger
+	Protocol       int
 	Host           string
 	Port           int
 	Path           string
@@ -35,79 +116,210 @@ type AccessLoggerConfig struct {
 	MaxBodyLogSize int64
 	BodyLogPolicy  int
 	RetryInterval  time.Duration
-}
 
-func buildLoggingMiddleware(conf AccessLoggerConfig, logQueue LogForwardingQueue) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var requestBody, responseBody string
-		var responseBodyLeech *LeechedGinResponseWriter
-		var requestBodyLeech *LeechedReadCloser
-
-		if conf.BodyLogPolicy != LogNoBody {
-			// Let's use a Leech to pump a limited amount of bytes on the request
-			// body into RAM as this body is read
-			bodySize := min(c.Request.ContentLength, conf.MaxBodyLogSize)
-
-			// If the Content-Length header ain't set let's use a buffer of
-			// MaxBodyLogSize to log the request body.
-			if _, ok := NoBodyHTTPMethods[c.Request.Method]; !ok && c.Request.Header.Get("content-length") == "" {
-				bodySize = conf.MaxBodyLogSize
-			}
-			requestBodyLeech = NewLeechedReadCloser(c.Request.Body, bodySize)
-			c.Request.Body = requestBodyLeech
-
-			// Let's do the same with the response body
-			responseBodyLeech = NewLeechedGinResponseWriter(c.Writer, conf.MaxBodyLogSize)
-			c.Writer = responseBodyLeech
-		}
+	// The last MaxBodyLogTailSize bytes of bodies larger than MaxBodyLogSize are logged as well,
+	// error responses tend to put their most interesting bits (stack traces, ...) at the end
+	MaxBodyLogTailSize int64
 
-		// Start chrono
-		startDate := time.Now()
+	// Bodies of textual content types are logged as text, binary ones according to
+	// BinaryBodyEncoding (BinaryBodiesBase64 by default). When BodyContentTypes is set, only bodies
+	// of these content types ("application/json", "text/*"...) are logged.
+	BinaryBodyEncoding int
+	BodyContentTypes   []string
 
-		// Let's process the request
-		c.Next()
+	// Bodies sent with a gzip, deflate or br Content-Encoding are decompressed before being logged,
+	// up to MaxBodyLogSize bytes of decompressed output. What the handler and client get is left
+	// untouched.
+	DecompressBodies bool
 
-		latency := time.Since(startDate)
+	// Rules overriding the logging policy for specific routes, methods, paths or status classes,
+	// the first matching rule applies
+	Rules []LogRule
 
-		// However, the response's Header object will be dereferenced... we'll have
-		// to store them them apart since we want to read them from the formatting
-		// goroutine
-		responseHeaders := make(map[string][]string)
-		for name, value := range c.Writer.Header() {
-			responseHeaders[name] = value
-		}
+	// HTTPRoute returns the route of a request for the net/http middleware, its ServeMux pattern by
+	// default. Routers that don't set it, such as chi, need one: with chi,
+	// func(r *http.Request) string { return chi.RouteContext(r.Context()).RoutePattern() }
+	HTTPRoute func(r *http.Request) string
+
+	// Sampling: only SampleRatio (in ]0, 1[) of the requests are logged, and no more than
+	// SampleRateLimit logs per second and per route. SampleKeepErrors and SampleKeepLatency make
+	// sure 4xx & 5xx and slow requests are always logged. Logs carry the number of requests to the
+	// same route that were sampled out (or whose logs were dropped) before them, so that totals can
+	// be reconstructed.
+	SampleRatio       float64
+	SampleRateLimit   float64
+	SampleKeepErrors  bool
+	SampleKeepLatency time.Duration
+
+	// Header carrying the request ID: it's read from the request (a new ID is generated if it's
+	// missing) and set on the response. Defaults to X-Request-ID.
+	RequestIDHeader string
+
+	// Timestamps are formatted with TimeFormat (time.RFC3339Nano by default) in the TimeLocation time
+	// zone (local time by default). EpochTimestamps (EpochMillis or EpochNanos) adds start and end
+	// times as Unix timestamps. DurationUnit is one of DurationMicroseconds (the default),
+	// DurationMilliseconds or DurationNanoseconds.
+	TimeFormat      string
+	TimeLocation    *time.Location
+	EpochTimestamps int
+	DurationUnit    int
+
+	// Values of these query parameters are masked in logs, case insensitively, defaults to
+	// DefaultRedactedQueryParams (use an empty, non-nil slice to log all of them)
+	RedactedQueryParams []string
+
+	// Header policies: when HeaderAllowList is set, only these headers are logged. Headers in
+	// HeaderDenyList are never logged. RedactedHeaders maps header names to a redaction mode
+	// (HeaderRedactMask, HeaderRedactDrop, HeaderRedactHash or HeaderRedactKeepPrefix) and defaults
+	// to DefaultRedactedHeaders (use an empty, non-nil map to disable redaction). HeaderHashKey is
+	// the HMAC key used by HeaderRedactHash, a random one is generated when not set.
+	HeaderAllowList        []string
+	HeaderDenyList         []string
+	RedactedHeaders        map[string]int
+	HeaderHashKey          []byte
+	HeaderKeepPrefixLength int
+
+	// Fields masked in JSON and form-urlencoded bodies: JSON pointers ("/card/number"), dotted paths
+	// where "*" matches any key or index and "**" any number of them ("*.password", "card.number")
+	// or key names, matched at any depth ("password"). Defaults to DefaultRedactedBodyFields (use an
+	// empty, non-nil slice to log bodies as they are).
+	RedactedBodyFields []string
+
+	// Retry policy: the delay between two attempts starts at RetryInterval and is multiplied by
+	// RetryMultiplier after each failure, up to RetryMaxInterval, then randomized by +/- RetryJitter
+	// (a negative value disables jitter). Deliveries are given up after RetryMaxAttempts attempts,
+	// when set, or RetryMaxElapsedTime (15 minutes by default, a negative value retries forever),
+	// and the logs handed to DeadLetter. Requests the backend rejects as invalid (4xx other than
+	// 429) aren't retried.
+	RetryMaxInterval    time.Duration
+	RetryMultiplier     float64
+	RetryJitter         float64
+	RetryMaxAttempts    int
+	RetryMaxElapsedTime time.Duration
+	DeadLetter          func(entries []AccessLog, err error)
+
+	// Metrics of the logging pipeline itself (see ExpvarMetrics)
+	Metrics Metrics
+
+	// RED (rate, errors, duration) metrics of the requests themselves, all the requests that aren't
+	// skipped by a rule are accounted for, sampled out ones included
+	REDMetrics *REDMetrics
+
+	// Disk spool: when SpoolDir is set, logs that don't fit in the queue, as well as logs the retry
+	// policy gave up on (unless DeadLetter is set), are written to disk, up to SpoolMaxSize bytes.
+	// They're fed back to the forwarder once it catches up, including after a restart.
+	SpoolDir          string
+	SpoolMaxSize      int64
+	SpoolSync         int
+	SpoolSyncInterval time.Duration
+
+	// Batching (HTTP forwarder only): logs are accumulated and posted together once BatchSize
+	// entries have been gathered or FlushInterval has elapsed, whichever comes first
+	BatchSize     int
+	FlushInterval time.Duration
+	BatchFormat   int
+
+	// Fluentd forward protocol options, the tag is taken from Path
+	FluentdMode       int
+	FluentdRequireAck bool
+
+	// Base URL of HTTP-based backends other than ProtocolHTTP (Elasticsearch, Loki...), such as
+	// "https://elasticsearch.example.com:9200", overriding Host and Port
+	URL string
 
-		responseContentLength := max(c.Writer.Size(), 0)
+	// Elasticsearch options: logs are indexed in ElasticsearchIndex, where %Y, %m, %d and %H are
+	// replaced with their start date ("gin-requests-%Y.%m.%d" by default). Requests are
+	// authenticated with ElasticsearchAPIKey or, if it isn't set, ElasticsearchUsername and
+	// ElasticsearchPassword.
+	ElasticsearchIndex    string
+	ElasticsearchUsername string
+	ElasticsearchPassword string
+	ElasticsearchAPIKey   string
 
-		// Shall we pass the body as well ? If so let's not dereference it !
-		if conf.BodyLogPolicy == LogAllBodies || conf.BodyLogPolicy == LogBodiesOnErrors && c.Writer.Status() >= 400 {
+	// Loki options: logs are grouped into streams labelled with LokiLabels (such as
+	// {"service": "api"}) and the LokiStreamLabels of each log (LokiLabelMethod,
+	// LokiLabelStatusClass, LokiLabelRoute; DefaultLokiStreamLabels by default). Push requests are
+	// sent as JSON, or as snappy-compressed protobuf when LokiProtobuf is set.
+	LokiLabels       map[string]string
+	LokiStreamLabels []string
+	LokiProtobuf     bool
 
-			// And parse all this to UTF-8 strings
-			requestBody = string(requestBodyLeech.GetLog())
-			responseBody = string(responseBodyLeech.data)
+	// OpenTelemetry options: logs are exported as OTLP log records, using the semantic conventions
+	// for HTTP, with OTLPResourceAttributes (such as {"service.name": "api"}) as resource
+	// attributes. Export requests are sent as JSON, or as protobuf when OTLPProtobuf is set.
+	OTLPResourceAttributes map[string]string
+	OTLPProtobuf           bool
+
+	// Syslog options: messages are sent to Host:Port over SyslogTransport (SyslogTransportUDP by
+	// default, SyslogTLSConfig being used with SyslogTransportTLS), in SyslogFormat
+	// (SyslogFormatJSON by default). Their facility is SyslogFacility (local0, 16, by default),
+	// their APP-NAME SyslogAppName ("gin-http-logger" by default) and their HOSTNAME
+	// SyslogHostname (the hostname of the machine by default).
+	SyslogTransport int
+	SyslogTLSConfig *tls.Config
+	SyslogFormat    int
+	SyslogFacility  int
+	SyslogAppName   string
+	SyslogHostname  string
+
+	// GELF options: messages are sent to Host:Port over GELFTransport (GELFTransportUDP by
+	// default). Over UDP, they're compressed with GELFCompression (GELFCompressionGzip by default)
+	// and split into chunks of GELFChunkSize bytes (1420 by default) when they're larger than
+	// that. Their host is GELFHost (the hostname of the machine by default).
+	GELFTransport   int
+	GELFCompression int
+	GELFChunkSize   int
+	GELFHost        string
+}
+
+func buildLoggingMiddleware(conf AccessLoggerConfig, logger *AccessLogger) gin.HandlerFunc {
+	core := newLoggingCore(conf, logger)
+
+	return func(c *gin.Context) {
+		e := core.begin(c.Request, c.FullPath(), c.Writer.Header())
+		if e == nil {
+			c.Next()
+			return
 		}
 
-		// Let's wrap all that into a channel-friendly struct
-		logEntry := Log{
-			context:               c.Copy(),
-			startDate:             startDate,
-			latency:               latency,
-			responseHeaders:       responseHeaders,
-			requestBody:           requestBody,
-			responseBody:          responseBody,
-			responseContentLength: int64(responseContentLength),
+		// Let's do the same with the response body
+		if e.captureSize > 0 {
+			responseBodyLeech := NewHeadTailLeechedGinResponseWriter(c.Writer, e.captureSize, conf.MaxBodyLogTailSize)
+			c.Writer = responseBodyLeech
+			e.responseCapture = &responseBodyLeech.bodyCapture
 		}
 
-		select {
-		case logQueue.intake() <- logEntry:
-		default:
-			log.Println("[WARNING][http-logging-middleware] Impossible to forward requests into log queue, channel full.")
+		if e.requestID != "" {
+			c.Set(ContextKeyRequestID, e.requestID)
+		}
+		if e.trace.traceID != "" {
+			c.Set(ContextKeyTraceID, e.trace.traceID)
+			c.Set(ContextKeyParentSpanID, e.trace.parentSpanID)
+			c.Set(ContextKeyTraceState, e.trace.traceState)
 		}
+
+		// Let's process the request
+		c.Next()
+
+		e.end(c.Request, handledResponse{
+			route:    c.FullPath(),
+			clientIP: c.ClientIP(),
+			errors:   c.Errors.String(),
+			status:   c.Writer.Status(),
+			size:     c.Writer.Size(),
+			header:   c.Writer.Header(),
+		})
 	}
 }
 
 // New returns an gin.HandlerFunc that will log our HTTP requests
 func New(conf AccessLoggerConfig) gin.HandlerFunc {
+	return NewAccessLogger(conf).Middleware()
+}
+
+// NewAccessLogger starts the log forwarding goroutine and returns a handle on it, from which the
+// middleware can be obtained and pending logs flushed before the server exits
+func NewAccessLogger(conf AccessLoggerConfig) *AccessLogger {
 	// Parse configuration, apply default arguments
 	// (Host and Port are mandatory)
 	if conf.BodyLogPolicy == 0 {
@@ -125,21 +337,156 @@ func New(conf AccessLoggerConfig) gin.HandlerFunc {
 	if conf.MaxBodyLogSize == 0 {
 		conf.MaxBodyLogSize = 4096
 	}
+	if conf.BinaryBodyEncoding == 0 {
+		conf.BinaryBodyEncoding = BinaryBodiesBase64
+	}
 
 	if conf.RetryInterval == 0 {
 		conf.RetryInterval = 10 * time.Second
 	}
 
+	if conf.RequestIDHeader == "" {
+		conf.RequestIDHeader = "X-Request-ID"
+	}
+
+	if conf.HeaderKeepPrefixLength == 0 {
+		conf.HeaderKeepPrefixLength = 6
+	}
+
+	if conf.RetryMaxInterval == 0 {
+		conf.RetryMaxInterval = 5 * time.Minute
+	}
+
+	if conf.RetryMultiplier == 0 {
+		conf.RetryMultiplier = 2
+	} else if conf.RetryMultiplier < 1 {
+		log.Printf("[WARNING][http-logging-middleware] Invalid RetryMultiplier %v, it can't be lower than 1, using 2 instead", conf.RetryMultiplier)
+		conf.RetryMultiplier = 2
+	}
+
+	if conf.RetryMaxElapsedTime == 0 {
+		conf.RetryMaxElapsedTime = 15 * time.Minute
+	}
+
+	if conf.RetryJitter == 0 {
+		conf.RetryJitter = 0.2
+	}
+
+	if conf.SpoolMaxSize == 0 {
+		conf.SpoolMaxSize = 1 << 30
+	}
+
+	if conf.SpoolSync == 0 {
+		conf.SpoolSync = SpoolSyncPeriodic
+	}
+
+	if conf.SpoolSyncInterval == 0 {
+		conf.SpoolSyncInterval = time.Second
+	}
+
+	if conf.BatchSize == 0 {
+		conf.BatchSize = 1
+	}
+
+	if conf.FlushInterval == 0 {
+		conf.FlushInterval = 5 * time.Second
+	}
+
+	if conf.BatchFormat == 0 {
+		conf.BatchFormat = HTTPBatchJSONArray
+	}
+
+	if conf.SinkTimeout == 0 {
+		conf.SinkTimeout = 10 * time.Second
+	}
+
+	if conf.Protocol == 0 {
+		conf.Protocol = ProtocolHTTP
+	}
+
+	if conf.FluentdMode == 0 {
+		conf.FluentdMode = FluentdModeForward
+	}
+
+	if conf.ElasticsearchIndex == "" {
+		conf.ElasticsearchIndex = "gin-requests-%Y.%m.%d"
+	}
+
+	if conf.SyslogTransport == 0 {
+		conf.SyslogTransport = SyslogTransportUDP
+	}
+
+	if conf.SyslogFormat == 0 {
+		conf.SyslogFormat = SyslogFormatJSON
+	}
+
+	if conf.SyslogFacility == 0 {
+		conf.SyslogFacility = 16
+	}
+
+	if conf.SyslogAppName == "" {
+		conf.SyslogAppName = "gin-http-logger"
+	}
+
+	if conf.SyslogHostname == "" {
+		conf.SyslogHostname, _ = os.Hostname()
+	}
+
+	if conf.GELFTransport == 0 {
+		conf.GELFTransport = GELFTransportUDP
+	}
+
+	if conf.GELFCompression == 0 {
+		conf.GELFCompression = GELFCompressionGzip
+	}
+
+	if conf.GELFChunkSize == 0 {
+		conf.GELFChunkSize = 1420
+	}
+
+	if conf.GELFHost == "" {
+		conf.GELFHost, _ = os.Hostname()
+	}
+
 	// Apply configuration
+	var spool *diskSpool
+	if conf.SpoolDir != "" {
+		var err error
+		if spool, err = openDiskSpool(conf); err != nil {
+			log.Println("[ERROR][http-logging-middleware] Impossible to open spool, logs won't be spooled to disk:", err)
+		} else if conf.DeadLetter == nil {
+			conf.DeadLetter = spool.appendAll
+		}
+	}
+
 	var logQueue LogForwardingQueue
-	if len(conf.Host) > 0 && conf.Port != 0 {
-		logQueue = NewHTTPLogForwardingQueue(conf)
+	if conf.Sink != nil {
+		logQueue = NewSinkLogForwardingQueue(conf)
+	} else if len(conf.Host) > 0 && conf.Port != 0 || conf.URL != "" {
+		switch conf.Protocol {
+		case ProtocolFluentdForward:
+			logQueue = NewFluentdLogForwardingQueue(conf)
+		case ProtocolElasticsearch:
+			logQueue = NewElasticsearchLogForwardingQueue(conf)
+		case ProtocolLoki:
+			logQueue = NewLokiLogForwardingQueue(conf)
+		case ProtocolOTLP:
+			logQueue = NewOTLPLogForwardingQueue(conf)
+		case ProtocolSyslog:
+			logQueue = NewSyslogLogForwardingQueue(conf)
+		case ProtocolGELF:
+			logQueue = NewGELFLogForwardingQueue(conf)
+		default:
+			logQueue = NewHTTPLogForwardingQueue(conf)
+		}
 	} else if conf.LogrusLogger != nil {
 		logQueue = NewLogrusLogForwardingQueue(conf)
 	}
 
 	// Run the log-forwarding goroutine
-	go logQueue.run()
+	logger := newAccessLogger(conf, logQueue)
+	logger.spool = spool
+	logger.start()
 
-	return buildLoggingMiddleware(conf, logQueue)
+	return logger
 }
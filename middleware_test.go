@@ -2,9 +2,11 @@ package ginhttplogger
 
 import (
 	"bytes"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -27,7 +29,7 @@ func TestMiddlewareBodyLogging(t *testing.T) {
 
 	// Let's inject our middleware into Gin's router
 	logQueue := NewMockedLogForwardingQueue(conf)
-	router.Use(buildLoggingMiddleware(conf, logQueue))
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
 	go logQueue.run()
 
 	// Let's setup a test route that replies 200 and sends the request body back
@@ -68,3 +70,81 @@ func mirror(array []byte) (ret []byte) {
 	}
 	return ret
 }
+
+// Test that the route template and the query string are logged, with sensitive parameters masked
+func TestMiddlewareRouteAndQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{DropSize: 10}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	router.GET("/users/:id", func(c *gin.Context) {
+		c.Status(200)
+	})
+
+	r, _ := http.NewRequest("GET", "/users/42?fields=name&fields=email&access_token=s3cr%3At&x=a+b", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, "/users/42", payload.Request.Path)
+	assert.Equal(t, "/users/:id", payload.Request.Route)
+	assert.Equal(t, "fields=name&fields=email&access_token=%5BREDACTED%5D&x=a+b", payload.Request.Query)
+	assert.Equal(t, map[string]string{
+		"fields":       "name, email",
+		"access_token": "[REDACTED]",
+		"x":            "a b",
+	}, payload.Request.QueryParams)
+}
+
+// Test that the end of large bodies is logged along with their beginning when a tail size is set
+func TestMiddlewareHeadAndTailLogging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{
+		BodyLogPolicy:      LogAllBodies,
+		MaxBodyLogSize:     10,
+		MaxBodyLogTailSize: 20,
+		DropSize:           10,
+	}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	router.POST("/fail", func(c *gin.Context) {
+		io.Copy(io.Discard, c.Request.Body)
+		c.Writer.WriteString("Traceback (most recent call last):\n")
+		c.Writer.WriteString(strings.Repeat("  some frame\n", 100))
+		c.Writer.WriteString("ValueError: boom")
+		c.Status(500)
+	})
+
+	// A chunked request body, without a Content-Length
+	requestBody := strings.Repeat("a", 1000) + "the end"
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/fail", io.MultiReader(strings.NewReader(requestBody)))
+	r.ContentLength = -1
+	router.ServeHTTP(w, r)
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, HTTPContent{
+		Size:         int64(len(requestBody)),
+		Encoding:     BodyEncodingText,
+		Content:      "aaaaaaaaaa",
+		Tail:         "aaaaaaaaaaaaathe end",
+		Truncated:    true,
+		OmittedBytes: int64(len(requestBody) - 30),
+	}, payload.Request.Content)
+
+	responseContent := payload.Response.Content
+	assert.Equal(t, int64(w.Body.Len()), responseContent.Size)
+	assert.Equal(t, "Traceback ", responseContent.Content)
+	assert.Equal(t, "ame\nValueError: boom", responseContent.Tail)
+	assert.True(t, responseContent.Truncated)
+	assert.Equal(t, int64(w.Body.Len()-30), responseContent.OmittedBytes)
+}
@@ -0,0 +1,365 @@
+package ginhttplogger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Minimal MessagePack (https://github.com/msgpack/msgpack/blob/master/spec.md) encoder and decoder,
+// just enough to speak Fluentd's forward protocol without pulling a whole serialization library
+
+// msgpackEventTime is Fluentd's EventTime extension type (ext type 0), carrying nanoseconds
+type msgpackEventTime time.Time
+
+// msgpackBin forces a byte slice to be encoded as binary data rather than a string
+type msgpackBin []byte
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) bytes() []byte {
+	return e.buf
+}
+
+func (e *msgpackEncoder) reset() {
+	e.buf = e.buf[:0]
+}
+
+func (e *msgpackEncoder) writeUint(prefix byte, size int, v uint64) {
+	e.buf = append(e.buf, prefix)
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(v>>(8*uint(i))))
+	}
+}
+
+func (e *msgpackEncoder) encodeNil() {
+	e.buf = append(e.buf, 0xc0)
+}
+
+func (e *msgpackEncoder) encodeBool(v bool) {
+	if v {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.encodeUint(uint64(v))
+	case v >= -32:
+		e.buf = append(e.buf, byte(v))
+	case v >= math.MinInt8:
+		e.writeUint(0xd0, 1, uint64(v))
+	case v >= math.MinInt16:
+		e.writeUint(0xd1, 2, uint64(v))
+	case v >= math.MinInt32:
+		e.writeUint(0xd2, 4, uint64(v))
+	default:
+		e.writeUint(0xd3, 8, uint64(v))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.buf = append(e.buf, byte(v))
+	case v <= math.MaxUint8:
+		e.writeUint(0xcc, 1, v)
+	case v <= math.MaxUint16:
+		e.writeUint(0xcd, 2, v)
+	case v <= math.MaxUint32:
+		e.writeUint(0xce, 4, v)
+	default:
+		e.writeUint(0xcf, 8, v)
+	}
+}
+
+func (e *msgpackEncoder) encodeFloat(v float64) {
+	e.writeUint(0xcb, 8, math.Float64bits(v))
+}
+
+func (e *msgpackEncoder) encodeString(v string) {
+	n := len(v)
+	switch {
+	case n <= 31:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.writeUint(0xd9, 1, uint64(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xda, 2, uint64(n))
+	default:
+		e.writeUint(0xdb, 4, uint64(n))
+	}
+	e.buf = append(e.buf, v...)
+}
+
+func (e *msgpackEncoder) encodeBin(v []byte) {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		e.writeUint(0xc4, 1, uint64(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xc5, 2, uint64(n))
+	default:
+		e.writeUint(0xc6, 4, uint64(n))
+	}
+	e.buf = append(e.buf, v...)
+}
+
+func (e *msgpackEncoder) encodeArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xdc, 2, uint64(n))
+	default:
+		e.writeUint(0xdd, 4, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeMapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xde, 2, uint64(n))
+	default:
+		e.writeUint(0xdf, 4, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeEventTime(t time.Time) {
+	// fixext 8, type 0, seconds and nanoseconds as big endian uint32s
+	e.buf = append(e.buf, 0xd7, 0x00)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Unix()))
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+}
+
+// encode serializes the values produced by decoding JSON into an interface{} (with UseNumber), as
+// well as a few native types we need for the protocol itself
+func (e *msgpackEncoder) encode(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.encodeNil()
+	case bool:
+		e.encodeBool(v)
+	case int:
+		e.encodeInt(int64(v))
+	case int64:
+		e.encodeInt(v)
+	case uint64:
+		e.encodeUint(v)
+	case float64:
+		e.encodeFloat(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.encodeInt(i)
+		} else if f, err := v.Float64(); err == nil {
+			e.encodeFloat(f)
+		} else {
+			e.encodeString(v.String())
+		}
+	case string:
+		e.encodeString(v)
+	case msgpackBin:
+		e.encodeBin(v)
+	case msgpackEventTime:
+		e.encodeEventTime(time.Time(v))
+	case []interface{}:
+		e.encodeArrayHeader(len(v))
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// Sorting keys isn't required but keeps the output deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.encodeMapHeader(len(v))
+		for _, key := range keys {
+			e.encodeString(key)
+			if err := e.encode(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// msgpackDecode reads a single value from r. Maps are decoded as map[string]interface{} (non-string
+// keys are formatted with %v), extension types as their raw payload.
+func msgpackDecode(r *bufio.Reader) (interface{}, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case prefix <= 0x7f:
+		return int64(prefix), nil
+	case prefix >= 0xe0:
+		return int64(int8(prefix)), nil
+	case prefix&0xf0 == 0x80:
+		return msgpackDecodeMap(r, int(prefix&0x0f))
+	case prefix&0xf0 == 0x90:
+		return msgpackDecodeArray(r, int(prefix&0x0f))
+	case prefix&0xe0 == 0xa0:
+		return msgpackReadString(r, int(prefix&0x1f))
+	}
+
+	switch prefix {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := msgpackReadUint(r, 1<<(prefix-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadBytes(r, int(n))
+	case 0xca:
+		n, err := msgpackReadUint(r, 4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := msgpackReadUint(r, 8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := msgpackReadUint(r, 1<<(prefix-0xcc))
+		return n, err
+	case 0xd0:
+		n, err := msgpackReadUint(r, 1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := msgpackReadUint(r, 2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := msgpackReadUint(r, 4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := msgpackReadUint(r, 8)
+		return int64(n), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		return msgpackReadBytes(r, 1<<(prefix-0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := msgpackReadUint(r, 1<<(prefix-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		return msgpackReadBytes(r, int(n))
+	case 0xd9, 0xda, 0xdb:
+		n, err := msgpackReadUint(r, 1<<(prefix-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadString(r, int(n))
+	case 0xdc, 0xdd:
+		n, err := msgpackReadUint(r, 2<<(prefix-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackDecodeArray(r, int(n))
+	case 0xde, 0xdf:
+		n, err := msgpackReadUint(r, 2<<(prefix-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackDecodeMap(r, int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid prefix 0x%x", prefix)
+}
+
+func msgpackReadUint(r *bufio.Reader, size int) (uint64, error) {
+	b, err := msgpackReadBytes(r, size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// msgpackMaxLength bounds the length of the strings, binaries, arrays and maps we decode: we only
+// read acks, a peer announcing more is broken and we shouldn't allocate whatever it asks for
+const msgpackMaxLength = 1 << 20
+
+func msgpackCheckLength(n int) error {
+	if n < 0 || n > msgpackMaxLength {
+		return fmt.Errorf("msgpack: length %d exceeds the %d limit", n, msgpackMaxLength)
+	}
+	return nil
+}
+
+func msgpackReadBytes(r *bufio.Reader, n int) ([]byte, error) {
+	if err := msgpackCheckLength(n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func msgpackReadString(r *bufio.Reader, n int) (string, error) {
+	b, err := msgpackReadBytes(r, n)
+	return string(b), err
+}
+
+func msgpackDecodeArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	if err := msgpackCheckLength(n); err != nil {
+		return nil, err
+	}
+	array := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		item, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, item)
+	}
+	return array, nil
+}
+
+func msgpackDecodeMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	if err := msgpackCheckLength(n); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprintf("%v", key)] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,195 @@
+package ginhttplogger
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the request duration histogram buckets
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the upper bounds, in bytes, of the request and response size histogram
+// buckets
+var DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// standardMethods get their own method label, other methods are labelled OTHER so that clients can't
+// create new series at will
+var standardMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// PrometheusCollector is implemented by the metrics we can expose in the Prometheus text format
+type PrometheusCollector interface {
+	WritePrometheus(w io.Writer)
+}
+
+// REDMetrics maintains request Rate, Errors and Duration metrics (as well as body sizes), derived
+// from the same measurements as our access logs, labelled by route template, method and status
+// class. Set it as AccessLoggerConfig.REDMetrics and expose it with PrometheusHandler.
+type REDMetrics struct {
+	latencyBuckets []float64
+	sizeBuckets    []float64
+
+	mutex  sync.Mutex
+	series map[redLabels]*redSeries
+}
+
+type redLabels struct {
+	route       string
+	method      string
+	statusClass string
+}
+
+type redSeries struct {
+	requests     int64
+	latency      histogram
+	requestSize  histogram
+	responseSize histogram
+}
+
+// histogram counts observations per bucket, buckets aren't cumulative until they're written
+type histogram struct {
+	counts []int64 // one more than there are buckets, for +Inf
+	sum    float64
+	count  int64
+}
+
+// NewREDMetrics creates RED metrics with the given histogram buckets, nil buckets stand for
+// DefaultLatencyBuckets and DefaultSizeBuckets. Buckets don't have to be sorted.
+func NewREDMetrics(latencyBuckets []float64, sizeBuckets []float64) *REDMetrics {
+	if latencyBuckets == nil {
+		latencyBuckets = DefaultLatencyBuckets
+	}
+	if sizeBuckets == nil {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	return &REDMetrics{
+		latencyBuckets: histogramBuckets(latencyBuckets),
+		sizeBuckets:    histogramBuckets(sizeBuckets),
+		series:         make(map[redLabels]*redSeries),
+	}
+}
+
+// histogramBuckets returns a sorted copy of buckets, without duplicates. The +Inf bucket is always
+// written, it's left out as well as NaNs.
+func histogramBuckets(buckets []float64) []float64 {
+	sorted := make([]float64, 0, len(buckets))
+	for _, bound := range buckets {
+		if !math.IsNaN(bound) && !math.IsInf(bound, 1) {
+			sorted = append(sorted, bound)
+		}
+	}
+	sort.Float64s(sorted)
+
+	unique := sorted[:0]
+	for i, bound := range sorted {
+		if i == 0 || bound != sorted[i-1] {
+			unique = append(unique, bound)
+		}
+	}
+	return unique
+}
+
+// normalizeMethod returns the method label of a request
+func normalizeMethod(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// observe records a request
+func (m *REDMetrics) observe(route, method string, status int, latency time.Duration, requestSize, responseSize int64) {
+	labels := redLabels{route: route, method: normalizeMethod(method), statusClass: fmt.Sprintf("%dxx", status/100)}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series, ok := m.series[labels]
+	if !ok {
+		series = &redSeries{
+			latency:      histogram{counts: make([]int64, len(m.latencyBuckets)+1)},
+			requestSize:  histogram{counts: make([]int64, len(m.sizeBuckets)+1)},
+			responseSize: histogram{counts: make([]int64, len(m.sizeBuckets)+1)},
+		}
+		m.series[labels] = series
+	}
+
+	series.requests++
+	series.latency.observe(m.latencyBuckets, latency.Seconds())
+	series.requestSize.observe(m.sizeBuckets, float64(requestSize))
+	series.responseSize.observe(m.sizeBuckets, float64(responseSize))
+}
+
+func (h *histogram) observe(buckets []float64, value float64) {
+	h.counts[sort.SearchFloat64s(buckets, value)]++
+	h.sum += value
+	h.count++
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (m *REDMetrics) WritePrometheus(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := make([]redLabels, 0, len(m.series))
+	for l := range m.series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].statusClass < labels[j].statusClass
+	})
+
+	fmt.Fprintln(w, "# HELP ginhttplogger_http_requests_total HTTP requests processed.")
+	fmt.Fprintln(w, "# TYPE ginhttplogger_http_requests_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "ginhttplogger_http_requests_total{%s} %d\n", l, m.series[l].requests)
+	}
+
+	writeHistogram := func(name, help string, buckets []float64, get func(*redSeries) *histogram) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for _, l := range labels {
+			h := get(m.series[l])
+			var cumulative int64
+			for i, bound := range buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+		}
+	}
+	writeHistogram("ginhttplogger_http_request_duration_seconds", "HTTP request latencies.", m.latencyBuckets,
+		func(s *redSeries) *histogram { return &s.latency })
+	writeHistogram("ginhttplogger_http_request_size_bytes", "HTTP request body sizes.", m.sizeBuckets,
+		func(s *redSeries) *histogram { return &s.requestSize })
+	writeHistogram("ginhttplogger_http_response_size_bytes", "HTTP response body sizes.", m.sizeBuckets,
+		func(s *redSeries) *histogram { return &s.responseSize })
+}
+
+// String formats labels the Prometheus way
+func (l redLabels) String() string {
+	return fmt.Sprintf(`route="%s",method="%s",status_class="%s"`,
+		escapeLabelValue(l.route), escapeLabelValue(l.method), escapeLabelValue(l.statusClass))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,62 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that RED metrics are maintained per route, method and status class
+func TestREDMetrics(t *testing.T) {
+	redMetrics := NewREDMetrics([]float64{0.1, 1}, []float64{10, 100})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	conf := AccessLoggerConfig{DropSize: 10, REDMetrics: redMetrics}
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, NewMockedLogForwardingQueue(conf))))
+	router.POST("/users/:id", func(c *gin.Context) {
+		c.String(201, strings.Repeat("a", 50))
+	})
+	router.GET("/metrics", PrometheusHandler(redMetrics))
+
+	for _, id := range []string{"1", "2"} {
+		r, _ := http.NewRequest("POST", "/users/"+id, bytes.NewReader([]byte("hello")))
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var buf bytes.Buffer
+	redMetrics.WritePrometheus(&buf)
+	output := buf.String()
+	labels := `route="/users/:id",method="POST",status_class="2xx"`
+	assert.Contains(t, output, "ginhttplogger_http_requests_total{"+labels+"} 2\n")
+	assert.Contains(t, output, "ginhttplogger_http_request_duration_seconds_bucket{"+labels+",le=\"0.1\"} 2\n")
+	assert.Contains(t, output, "ginhttplogger_http_request_size_bytes_bucket{"+labels+",le=\"10\"} 2\n")
+	assert.Contains(t, output, "ginhttplogger_http_request_size_bytes_sum{"+labels+"} 10\n")
+	assert.Contains(t, output, "ginhttplogger_http_response_size_bytes_bucket{"+labels+",le=\"10\"} 0\n")
+	assert.Contains(t, output, "ginhttplogger_http_response_size_bytes_bucket{"+labels+",le=\"100\"} 2\n")
+	assert.Contains(t, output, "ginhttplogger_http_response_size_bytes_bucket{"+labels+",le=\"+Inf\"} 2\n")
+	assert.Contains(t, output, "ginhttplogger_http_response_size_bytes_count{"+labels+"} 2\n")
+}
+
+// Test that non standard methods share a label, and that buckets are sorted and deduplicated
+func TestREDMetricsNormalization(t *testing.T) {
+	redMetrics := NewREDMetrics([]float64{1, 0.1, 1, math.Inf(1)}, nil)
+	assert.Equal(t, []float64{0.1, 1}, redMetrics.latencyBuckets)
+	assert.Equal(t, DefaultSizeBuckets, redMetrics.sizeBuckets)
+
+	for _, method := range []string{"GET", "PROPFIND", "XYZZY"} {
+		redMetrics.observe("/files", method, 200, time.Millisecond, 0, 0)
+	}
+	var buf bytes.Buffer
+	redMetrics.WritePrometheus(&buf)
+	assert.Contains(t, buf.String(), `ginhttplogger_http_requests_total{route="/files",method="GET",status_class="2xx"} 1`+"\n")
+	assert.Contains(t, buf.String(), `ginhttplogger_http_requests_total{route="/files",method="OTHER",status_class="2xx"} 2`+"\n")
+	assert.NotContains(t, buf.String(), "XYZZY")
+}
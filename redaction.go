@@ -0,0 +1,355 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactedBodyFields lists the body fields masked when AccessLoggerConfig.RedactedBodyFields
+// isn't set
+var DefaultRedactedBodyFields = []string{
+	"password",
+	"passwd",
+	"secret",
+	"client_secret",
+	"token",
+	"access_token",
+	"refresh_token",
+	"api_key",
+	"card.number",
+	"card.cvc",
+}
+
+// bodyFieldPattern is a parsed field path pattern, segments are lowercased, "*" matches a single
+// segment and "**" any number of them
+type bodyFieldPattern []string
+
+// parseBodyFieldPattern accepts JSON pointers ("/card/number"), dotted paths ("card.number",
+// "*.password") and bare key names ("password", equivalent to "**.password")
+func parseBodyFieldPattern(pattern string) bodyFieldPattern {
+	var segments []string
+	if strings.HasPrefix(pattern, "/") {
+		for _, segment := range strings.Split(pattern[1:], "/") {
+			segment = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+			segments = append(segments, strings.ToLower(segment))
+		}
+		return segments
+	}
+
+	segments = strings.Split(strings.ToLower(pattern), ".")
+	if len(segments) == 1 && segments[0] != "*" && segments[0] != "**" {
+		segments = []string{"**", segments[0]}
+	}
+	return segments
+}
+
+func (p bodyFieldPattern) match(path []string) bool {
+	if len(p) == 0 {
+		return len(path) == 0
+	}
+	if p[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if p[1:].match(path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (p[0] != "*" && p[0] != strings.ToLower(path[0])) {
+		return false
+	}
+	return p[1:].match(path[1:])
+}
+
+type bodyRedactor []bodyFieldPattern
+
+func newBodyRedactor(patterns []string) (r bodyRedactor) {
+	for _, pattern := range patterns {
+		r = append(r, parseBodyFieldPattern(pattern))
+	}
+	return r
+}
+
+func (r bodyRedactor) match(path []string) bool {
+	for _, pattern := range r {
+		if pattern.match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact masks sensitive fields in JSON and form-urlencoded bodies, other bodies are left untouched
+func (r bodyRedactor) redact(body, contentType string) string {
+	if len(r) == 0 || body == "" {
+		return body
+	}
+
+	switch bodyMimeType(contentType) {
+	case "json":
+		return r.redactJSON(body)
+	case "form":
+		return r.redactForm(body)
+	}
+	return body
+}
+
+// redactTail masks sensitive fields in the tail of a JSON or form-urlencoded body. Tails start
+// anywhere in the document: their leading fragment, which may be the end of a sensitive value, is
+// dropped and, since the paths of the fields that follow can't be known, values are masked whenever
+// their key matches the last segment of a pattern.
+func (r bodyRedactor) redactTail(tail, contentType string) string {
+	if len(r) == 0 || tail == "" {
+		return tail
+	}
+
+	var separator byte
+	switch bodyMimeType(contentType) {
+	case "json":
+		separator = ','
+	case "form":
+		separator = '&'
+	default:
+		return tail
+	}
+
+	i := strings.IndexByte(tail, separator)
+	if i < 0 {
+		return ""
+	}
+	if separator == '&' {
+		return r.redactForm(tail[i:])
+	}
+	return r.redactJSONTail(tail[i:])
+}
+
+// bodyMimeType tells whether a content type is one of the "json" or "form" bodies we can redact
+func bodyMimeType(contentType string) string {
+	mimeType := mimeTypeOf(contentType)
+	switch {
+	case mimeType == "application/json" || strings.HasSuffix(mimeType, "+json"):
+		return "json"
+	case mimeType == "application/x-www-form-urlencoded":
+		return "form"
+	}
+	return ""
+}
+
+// redactForm masks the values of matching form fields, preserving the ordering and encoding of the
+// body. The last field may have been truncated, it's masked all the same if its name matches. Field
+// names such as "card.number" or "card[number]" are matched as nested paths.
+func (r bodyRedactor) redactForm(body string) string {
+	pairs := strings.Split(body, "&")
+	for i, pair := range pairs {
+		j := strings.IndexByte(pair, '=')
+		if j < 0 {
+			continue
+		}
+		name, err := url.QueryUnescape(pair[:j])
+		if err != nil {
+			name = pair[:j]
+		}
+		path := strings.FieldsFunc(name, func(c rune) bool { return c == '.' || c == '[' || c == ']' })
+		if r.match(path) {
+			pairs[i] = pair[:j] + "=" + url.QueryEscape(redactedValue)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// jsonContainer tracks where we are in the JSON document being redacted
+type jsonContainer struct {
+	object bool
+	items  int    // number of keys and values written in the container so far
+	key    string // key (or index, in arrays) of the value being written in the container
+}
+
+// redactJSON rewrites a JSON body token by token, masking matching values. Bodies truncated at
+// MaxBodyLogSize aren't valid JSON: we stop at the last complete token, masking the truncated
+// value if its path matches. Bodies without any sensitive field are returned as they are.
+func (r bodyRedactor) redactJSON(body string) string {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+
+	var out bytes.Buffer
+	var stack []jsonContainer
+	redacted := false
+
+	expectingKey := func() bool {
+		return len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].items%2 == 0
+	}
+
+	// nextValue writes the comma or colon expected before the next value and returns its path
+	nextValue := func() []string {
+		if len(stack) == 0 {
+			return nil
+		}
+		top := &stack[len(stack)-1]
+		if top.object {
+			out.WriteByte(':')
+		} else {
+			if top.items > 0 {
+				out.WriteByte(',')
+			}
+			top.key = strconv.Itoa(top.items)
+		}
+		top.items++
+
+		path := make([]string, 0, len(stack))
+		for _, container := range stack {
+			path = append(path, container.key)
+		}
+		return path
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// End of the body, or truncated token: let's make sure we don't leak the beginning of a
+			// sensitive value
+			if len(stack) > 0 && !expectingKey() {
+				written := out.Len()
+				if r.match(nextValue()) {
+					out.WriteString(strconv.Quote(redactedValue))
+					redacted = true
+				} else {
+					out.Truncate(written)
+				}
+			}
+			break
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			out.WriteByte(byte(delim))
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if expectingKey() {
+			top := &stack[len(stack)-1]
+			if top.items > 0 {
+				out.WriteByte(',')
+			}
+			top.items++
+			top.key, _ = token.(string)
+			keyJSON, _ := json.Marshal(top.key)
+			out.Write(keyJSON)
+			continue
+		}
+
+		// We're about to write a value, let's see if it should be masked
+		if r.match(nextValue()) {
+			redacted = true
+			out.WriteString(strconv.Quote(redactedValue))
+			if _, ok := token.(json.Delim); ok {
+				// Let's skip the whole object or array
+				for depth := 1; depth > 0; {
+					token, err := decoder.Token()
+					if err != nil {
+						break
+					}
+					if delim, ok := token.(json.Delim); ok {
+						if delim == '{' || delim == '[' {
+							depth++
+						} else {
+							depth--
+						}
+					}
+				}
+			}
+			continue
+		}
+
+		switch token := token.(type) {
+		case json.Delim:
+			out.WriteByte(byte(token))
+			stack = append(stack, jsonContainer{object: token == '{'})
+		case json.Number:
+			out.WriteString(token.String())
+		default:
+			tokenJSON, _ := json.Marshal(token)
+			out.Write(tokenJSON)
+		}
+	}
+
+	if !redacted {
+		return body
+	}
+	return out.String()
+}
+
+var jsonTailKey = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"\s*:\s*`)
+
+// redactJSONTail masks the values of the keys matching matchKey in a JSON fragment
+func (r bodyRedactor) redactJSONTail(tail string) string {
+	var out strings.Builder
+	for {
+		loc := jsonTailKey.FindStringSubmatchIndex(tail)
+		if loc == nil {
+			out.WriteString(tail)
+			return out.String()
+		}
+
+		key, err := strconv.Unquote(tail[loc[2]-1 : loc[3]+1])
+		if err != nil {
+			key = tail[loc[2]:loc[3]]
+		}
+		out.WriteString(tail[:loc[1]])
+		tail = tail[loc[1]:]
+		if r.matchKey(key) {
+			out.WriteString(strconv.Quote(redactedValue))
+			tail = tail[jsonValueLength(tail):]
+		}
+	}
+}
+
+// matchKey tells whether a key may be the one of a sensitive field, whatever its path
+func (r bodyRedactor) matchKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range r {
+		if len(pattern) == 0 {
+			continue
+		}
+		if last := pattern[len(pattern)-1]; last == key || last == "*" || last == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonValueLength returns the length of the JSON value s starts with, or len(s) if it's truncated
+func jsonValueLength(s string) int {
+	depth, inString := 0, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			if depth == 0 {
+				return i
+			}
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case depth == 0 && (c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			return i
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,96 @@
+package ginhttplogger
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy retries failed deliveries with an exponential, randomized backoff
+type retryPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	multiplier      float64
+	jitter          float64
+	maxAttempts     int
+	maxElapsedTime  time.Duration
+	deadLetter      func(entries []AccessLog, err error)
+	metrics         Metrics
+}
+
+func newRetryPolicy(conf AccessLoggerConfig) retryPolicy {
+	return retryPolicy{
+		initialInterval: conf.RetryInterval,
+		maxInterval:     conf.RetryMaxInterval,
+		multiplier:      maxFloat(conf.RetryMultiplier, 1),
+		jitter:          maxFloat(conf.RetryJitter, 0),
+		maxAttempts:     conf.RetryMaxAttempts,
+		maxElapsedTime:  conf.RetryMaxElapsedTime,
+		deadLetter:      conf.DeadLetter,
+		metrics:         pipelineMetrics(conf),
+	}
+}
+
+// permanentError is an error retrying won't fix (an invalid request rejected by the backend...)
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks an error as one retrying won't fix, the retry policy gives up on it right away
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// run calls attempt until it succeeds or until we run out of attempts or time, in which case the
+// last error is returned. Permanent errors are returned right away.
+func (p retryPolicy) run(attempt func() error) error {
+	start := time.Now()
+	interval := p.initialInterval
+
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if errors.As(err, &permanentError{}) {
+			return err
+		}
+
+		if p.maxAttempts > 0 && attempts >= p.maxAttempts {
+			return err
+		}
+
+		// Let's randomize the delay by +/- jitter so that all our replicas don't hammer the backend
+		// at the same time when it comes back
+		wait := time.Duration(float64(interval) * (1 + p.jitter*(2*rand.Float64()-1)))
+		if p.maxElapsedTime > 0 && time.Since(start)+wait > p.maxElapsedTime {
+			return err
+		}
+		p.metrics.Retried()
+		time.Sleep(wait)
+
+		interval = time.Duration(float64(interval) * p.multiplier)
+		if interval > p.maxInterval {
+			interval = p.maxInterval
+		}
+	}
+}
+
+// discard hands logs we gave up on to the dead letter callback, if any
+func (p retryPolicy) discard(entries []AccessLog, err error) {
+	p.metrics.Failed(len(entries))
+	if p.deadLetter != nil {
+		p.deadLetter(entries, err)
+		return
+	}
+	log.Printf("[ERROR][http-logging-middleware] Giving up on %d request log(s): %v", len(entries), err)
+}
@@ -0,0 +1,144 @@
+package ginhttplogger
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// LogRule overrides the logging policy of the requests it matches. All the conditions that are set
+// must match, unset ones match every request.
+type LogRule struct {
+	// Conditions
+	Routes        []string       // gin route templates, as returned by c.FullPath() ("/users/:id")
+	Methods       []string       // HTTP methods
+	PathPrefix    string         // prefix of the request path
+	PathPattern   *regexp.Regexp // regular expression matched against the request path
+	StatusClasses []int          // response status classes: 2 for 2xx, 4 for 4xx...
+
+	// Actions
+	Skip           bool  // don't log matching requests at all
+	BodyLogPolicy  int   // overrides AccessLoggerConfig.BodyLogPolicy when set
+	MaxBodyLogSize int64 // overrides AccessLoggerConfig.MaxBodyLogSize when set
+}
+
+// logRule is a LogRule compiled for fast matching
+type logRule struct {
+	LogRule
+	routes        map[string]struct{}
+	methods       map[string]struct{}
+	statusClasses map[int]struct{}
+}
+
+// logRules are evaluated in order, the first rule matching a request applies
+type logRules []*logRule
+
+func compileLogRules(rules []LogRule) (compiled logRules) {
+	for _, rule := range rules {
+		r := &logRule{LogRule: rule}
+		if len(rule.Routes) > 0 {
+			r.routes = make(map[string]struct{})
+			for _, route := range rule.Routes {
+				r.routes[route] = struct{}{}
+			}
+		}
+		if len(rule.Methods) > 0 {
+			r.methods = make(map[string]struct{})
+			for _, method := range rule.Methods {
+				r.methods[strings.ToUpper(method)] = struct{}{}
+			}
+		}
+		if len(rule.StatusClasses) > 0 {
+			r.statusClasses = make(map[int]struct{})
+			for _, class := range rule.StatusClasses {
+				r.statusClasses[class] = struct{}{}
+			}
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled
+}
+
+func (r *logRule) matchesRequest(req *http.Request, route string) bool {
+	if r.routes != nil {
+		if _, ok := r.routes[route]; !ok {
+			return false
+		}
+	}
+	if r.methods != nil {
+		if _, ok := r.methods[req.Method]; !ok {
+			return false
+		}
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.PathPattern != nil && !r.PathPattern.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+func (r *logRule) matchesStatus(status int) bool {
+	if r.statusClasses == nil {
+		return true
+	}
+	_, ok := r.statusClasses[status/100]
+	return ok
+}
+
+// forRequest returns the rules that may apply to a request, depending on its response status. The
+// list stops at the first rule without status condition, since rules after it can't apply.
+func (rules logRules) forRequest(req *http.Request, route string) (candidates logRules) {
+	for _, rule := range rules {
+		if rule.matchesRequest(req, route) {
+			candidates = append(candidates, rule)
+			if rule.statusClasses == nil {
+				break
+			}
+		}
+	}
+	return candidates
+}
+
+// forStatus returns the rule applying to a request once its response status is known, nil if none
+func (candidates logRules) forStatus(status int) *logRule {
+	for _, rule := range candidates {
+		if rule.matchesStatus(status) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// bodyPolicy returns the body logging policy and max body size for requests matching this rule
+func (r *logRule) bodyPolicy(conf *AccessLoggerConfig) (policy int, maxSize int64) {
+	policy, maxSize = conf.BodyLogPolicy, conf.MaxBodyLogSize
+	if r == nil {
+		return policy, maxSize
+	}
+	if r.BodyLogPolicy != 0 {
+		policy = r.BodyLogPolicy
+	}
+	if r.MaxBodyLogSize != 0 {
+		maxSize = r.MaxBodyLogSize
+	}
+	return policy, maxSize
+}
+
+// captureSize returns how many bytes of the bodies have to be captured for a request, so that
+// whichever rule ends up applying gets what it needs. Zero means bodies aren't needed at all.
+func (candidates logRules) captureSize(conf *AccessLoggerConfig) (size int64) {
+	// When the last candidate has a status condition too, the default policy may apply
+	if len(candidates) == 0 || candidates[len(candidates)-1].statusClasses != nil {
+		if policy, maxSize := (*logRule)(nil).bodyPolicy(conf); policy != LogNoBody {
+			size = maxSize
+		}
+	}
+	for _, rule := range candidates {
+		if policy, maxSize := rule.bodyPolicy(conf); !rule.Skip && policy != LogNoBody {
+			size = max64(size, maxSize)
+		}
+	}
+	return size
+}
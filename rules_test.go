@@ -0,0 +1,75 @@
+package ginhttplogger
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that rules can skip requests and override body policies, depending on the response status
+func TestLogRules(t *testing.T) {
+	sink := &flakySink{}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	accessLogger := NewAccessLogger(AccessLoggerConfig{
+		Sink:           sink,
+		BodyLogPolicy:  LogNoBody,
+		MaxBodyLogSize: 4,
+		Rules: []LogRule{
+			{Routes: []string{"/health"}, Skip: true},
+			{PathPattern: regexp.MustCompile("^/metrics"), StatusClasses: []int{2}, Skip: true},
+			{Methods: []string{"post"}, PathPrefix: "/users", StatusClasses: []int{4, 5}, BodyLogPolicy: LogAllBodies, MaxBodyLogSize: 100},
+			{Routes: []string{"/users/:id"}, BodyLogPolicy: LogAllBodies},
+		},
+	})
+	router.Use(accessLogger.Middleware())
+
+	status := 200
+	reply := func(c *gin.Context) {
+		var buf bytes.Buffer
+		buf.ReadFrom(c.Request.Body)
+		c.String(status, "%s", buf.String())
+	}
+	router.GET("/health", reply)
+	router.GET("/metrics", reply)
+	router.POST("/users/:id", reply)
+
+	for _, request := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/health", 200},
+		{"GET", "/metrics", 200},
+		{"GET", "/metrics", 500},
+		{"POST", "/users/1", 200},
+		{"POST", "/users/1", 400},
+	} {
+		status = request.status
+		r, _ := http.NewRequest(request.method, request.path, bytes.NewReader([]byte("hello world")))
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, accessLogger.Shutdown(ctx))
+
+	assert.Len(t, sink.entries, 3)
+	assert.Equal(t, "/metrics", sink.entries[0].Request.Path)
+	assert.Equal(t, 500, sink.entries[0].Response.Status)
+	assert.Equal(t, "", sink.entries[0].Request.Content.Content, "Default policy should apply")
+
+	assert.Equal(t, 200, sink.entries[1].Response.Status)
+	assert.Equal(t, "hell", sink.entries[1].Request.Content.Content, "Route rule should apply")
+
+	assert.Equal(t, 400, sink.entries[2].Response.Status)
+	assert.Equal(t, "hello world", sink.entries[2].Request.Content.Content, "Error rule should apply")
+	assert.Equal(t, "hello world", sink.entries[2].Response.Content.Content, "Error rule should apply")
+}
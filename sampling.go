@@ -0,0 +1,113 @@
+package ginhttplogger
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sampler decides which requests get logged once they've been processed, so that errors and slow
+// requests can always be kept
+type sampler struct {
+	ratio       float64
+	rateLimit   float64
+	keepErrors  bool
+	keepLatency time.Duration
+
+	mutex      sync.Mutex
+	buckets    map[string]*tokenBucket
+	sampledOut map[string]int64
+}
+
+// tokenBucket rate limits logs of a given route
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// newSampler returns nil when sampling isn't enabled
+func newSampler(conf AccessLoggerConfig) *sampler {
+	if (conf.SampleRatio <= 0 || conf.SampleRatio >= 1) && conf.SampleRateLimit <= 0 {
+		return nil
+	}
+	return &sampler{
+		ratio:       conf.SampleRatio,
+		rateLimit:   conf.SampleRateLimit,
+		keepErrors:  conf.SampleKeepErrors,
+		keepLatency: conf.SampleKeepLatency,
+		buckets:     make(map[string]*tokenBucket),
+		sampledOut:  make(map[string]int64),
+	}
+}
+
+// sample returns whether a request should be logged and, if so, how many requests to the same
+// route were sampled out since the last one that was logged
+func (s *sampler) sample(route string, status int, latency time.Duration, traceID string) (keep bool, sampledOut int64) {
+	// Errors and slow requests bypass both the ratio and the rate limit
+	forced := s.keepErrors && status >= 400 || s.keepLatency > 0 && latency >= s.keepLatency
+	keep = forced || s.sampleRatio(traceID)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if keep && !forced {
+		keep = s.allow(route, time.Now())
+	}
+
+	if !keep {
+		s.sampledOut[route]++
+		return false, 0
+	}
+	sampledOut = s.sampledOut[route]
+	delete(s.sampledOut, route)
+	return true, sampledOut
+}
+
+// restore accounts for requests that were kept but whose logs ended up being dropped, so that the
+// next log of the route reports them along with the sampled out ones
+func (s *sampler) restore(route string, sampledOut int64) {
+	s.mutex.Lock()
+	s.sampledOut[route] += sampledOut
+	s.mutex.Unlock()
+}
+
+// sampleRatio keeps the configured share of requests. When the request belongs to a trace, the
+// decision is derived from the trace ID the same way OpenTelemetry's TraceIdRatioBased sampler
+// does, so that all the services of a trace keep (or drop) the same requests.
+func (s *sampler) sampleRatio(traceID string) bool {
+	if s.ratio <= 0 || s.ratio >= 1 {
+		return true
+	}
+
+	if len(traceID) >= 16 {
+		if lowBits, err := strconv.ParseUint(traceID[len(traceID)-16:], 16, 64); err == nil {
+			return lowBits>>1 < uint64(s.ratio*math.Exp2(63))
+		}
+	}
+	return rand.Float64() < s.ratio
+}
+
+// allow takes a token from the route's bucket, if the rate limit is enabled
+func (s *sampler) allow(route string, now time.Time) bool {
+	if s.rateLimit <= 0 {
+		return true
+	}
+
+	// Buckets can hold a second worth of logs, and at least one
+	burst := math.Max(s.rateLimit, 1)
+	bucket, ok := s.buckets[route]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, lastRefill: now}
+		s.buckets[route] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*s.rateLimit)
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,73 @@
+package ginhttplogger
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	// Without sampling options, there's no sampler at all
+	assert.Nil(t, newSampler(AccessLoggerConfig{SampleKeepErrors: true}))
+
+	s := newSampler(AccessLoggerConfig{SampleRatio: 0.5, SampleKeepErrors: true, SampleKeepLatency: time.Second})
+
+	// Decisions based on trace IDs are deterministic
+	assert.True(t, s.sampleRatio("4bf92f3577b34da60000000000000001"))
+	assert.False(t, s.sampleRatio("4bf92f3577b34da6ffffffffffffffff"))
+
+	// Errors and slow requests are always kept, and report the requests sampled out before them
+	keep, _ := s.sample("/users/:id", 200, time.Millisecond, "4bf92f3577b34da6ffffffffffffffff")
+	assert.False(t, keep)
+	keep, _ = s.sample("/users/:id", 200, time.Millisecond, "4bf92f3577b34da6ffffffffffffffff")
+	assert.False(t, keep)
+	keep, sampledOut := s.sample("/users/:id", 500, time.Millisecond, "4bf92f3577b34da6ffffffffffffffff")
+	assert.True(t, keep)
+	assert.Equal(t, int64(2), sampledOut)
+	keep, sampledOut = s.sample("/users/:id", 200, 2*time.Second, "4bf92f3577b34da6ffffffffffffffff")
+	assert.True(t, keep)
+	assert.Equal(t, int64(0), sampledOut)
+
+	// Requests whose logs were dropped are reported by the next log
+	s.restore("/users/:id", 3)
+	keep, sampledOut = s.sample("/users/:id", 500, time.Millisecond, "4bf92f3577b34da6ffffffffffffffff")
+	assert.True(t, keep)
+	assert.Equal(t, int64(3), sampledOut)
+}
+
+// Test that requests whose logs are dropped because the queue is full are still accounted for
+func TestSamplerDroppedLogs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{DropSize: 1, SampleRatio: 0.5, SampleKeepErrors: true}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	router.GET("/fail", func(c *gin.Context) { c.Status(500) })
+
+	// The first log fills the queue, the next two are dropped
+	for i := 0; i < 3; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	}
+	logEntry := <-logQueue.Intake
+	assert.Equal(t, int64(0), buildPayload(&logEntry).SampledOut)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	logEntry = <-logQueue.Intake
+	assert.Equal(t, int64(2), buildPayload(&logEntry).SampledOut)
+}
+
+func TestSamplerRateLimit(t *testing.T) {
+	s := newSampler(AccessLoggerConfig{SampleRateLimit: 2})
+	now := time.Now()
+
+	assert.True(t, s.allow("/a", now))
+	assert.True(t, s.allow("/a", now))
+	assert.False(t, s.allow("/a", now), "Bucket should be empty")
+	assert.True(t, s.allow("/b", now), "Routes should have their own bucket")
+	assert.True(t, s.allow("/a", now.Add(500*time.Millisecond)), "Bucket should have been refilled")
+	assert.False(t, s.allow("/a", now.Add(500*time.Millisecond)))
+}
@@ -0,0 +1,404 @@
+package ginhttplogger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spoolSegmentSize is the size after which a new segment file is started
+	spoolSegmentSize = 8 << 20
+	// spoolRecordHeaderSize is the size of the record header: payload length and CRC32, as uint32s
+	spoolRecordHeaderSize = 8
+	// spoolReplayInterval is the period at which the spool is drained into the forwarding queue
+	spoolReplayInterval = time.Second
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// spoolRecord is what gets written to disk, for every log
+type spoolRecord struct {
+	StartDate time.Time     `json:"start_date"`
+	Latency   time.Duration `json:"latency,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Log       AccessLog     `json:"log"`
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// diskSpool is a write-ahead queue of access logs, stored in segment files on local disk.
+//
+// Segments are named after an increasing sequence number and contain records made of an 8 bytes
+// header (payload length and CRC32) followed by a JSON encoded spoolRecord. The position of the
+// reader is persisted in a checkpoint file so that logs can be replayed after a restart, records
+// torn by a crash are detected thanks to their header and discarded.
+type diskSpool struct {
+	mutex        sync.Mutex
+	dir          string
+	maxSize      int64
+	segmentSize  int64
+	syncPolicy   int
+	syncInterval time.Duration
+
+	segments   []spoolSegment // oldest first, the last one is being written to
+	size       int64
+	writer     *os.File
+	reader     *os.File
+	readOffset int64
+	dirty      bool
+	closed     bool
+	stop       chan struct{}
+}
+
+// openDiskSpool opens (or creates) the spool stored in conf.SpoolDir
+func openDiskSpool(conf AccessLoggerConfig) (s *diskSpool, err error) {
+	s = &diskSpool{
+		dir:          conf.SpoolDir,
+		maxSize:      conf.SpoolMaxSize,
+		segmentSize:  min(spoolSegmentSize, max64(conf.SpoolMaxSize/4, 1)),
+		syncPolicy:   conf.SpoolSync,
+		syncInterval: conf.SpoolSyncInterval,
+		stop:         make(chan struct{}),
+	}
+
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Let's list existing segments
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		var seq uint64
+		if _, err := fmt.Sscanf(filepath.Base(file), "%020d.seg", &seq); err != nil {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	// Segments before the checkpoint have already been replayed
+	readSeq, readOffset := s.readCheckpoint()
+	for len(s.segments) > 0 && s.segments[0].seq < readSeq {
+		os.Remove(s.segmentPath(s.segments[0].seq))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == readSeq {
+		s.readOffset = readOffset
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = append(s.segments, spoolSegment{seq: readSeq + 1})
+	}
+
+	// The last segment may end with a record torn by a crash, let's cut it off before appending to it
+	last := &s.segments[len(s.segments)-1]
+	if s.writer, err = os.OpenFile(s.segmentPath(last.seq), os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		return nil, err
+	}
+	if validSize := s.validSize(s.writer, last.size); validSize != last.size {
+		log.Printf("[WARNING][http-logging-middleware] Discarding %d bytes of torn records in spool segment %d", last.size-validSize, last.seq)
+		if err = s.writer.Truncate(validSize); err != nil {
+			return nil, err
+		}
+		last.size = validSize
+	}
+	if _, err = s.writer.Seek(last.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	for _, segment := range s.segments {
+		s.size += segment.size
+	}
+
+	if s.syncPolicy == SpoolSyncPeriodic {
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+func (s *diskSpool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+func (s *diskSpool) checkpointPath() string {
+	return filepath.Join(s.dir, "checkpoint")
+}
+
+// readCheckpoint returns the position of the reader, as persisted on disk
+func (s *diskSpool) readCheckpoint() (seq uint64, offset int64) {
+	data, err := os.ReadFile(s.checkpointPath())
+	if err != nil {
+		return 0, 0
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d %d", &seq, &offset); err != nil {
+		log.Println("[WARNING][http-logging-middleware] Ignoring invalid spool checkpoint:", err)
+		return 0, 0
+	}
+	return seq, offset
+}
+
+// validSize returns the size of the longest sequence of intact records at the start of a segment
+func (s *diskSpool) validSize(f *os.File, size int64) (offset int64) {
+	for offset < size {
+		recordSize, ok := s.readRecord(f, offset, size, nil)
+		if !ok {
+			return offset
+		}
+		offset += recordSize
+	}
+	return offset
+}
+
+// readRecord reads the record at offset in f, size bytes long, decoding it into record if not nil. It
+// returns false if there's no complete and intact record at this offset.
+func (s *diskSpool) readRecord(f *os.File, offset, size int64, record *spoolRecord) (recordSize int64, ok bool) {
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return 0, false
+	}
+	// A torn or corrupted header mustn't have us allocate more than the file holds
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > size-offset-spoolRecordHeaderSize {
+		return 0, false
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+spoolRecordHeaderSize); err != nil {
+		return 0, false
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, false
+	}
+	if record != nil {
+		if err := json.Unmarshal(data, record); err != nil {
+			return 0, false
+		}
+	}
+	return int64(len(data)) + spoolRecordHeaderSize, true
+}
+
+// append writes a log at the end of the spool
+func (s *diskSpool) append(payload *AccessLog) error {
+	data, err := json.Marshal(spoolRecord{StartDate: payload.startDate, Latency: payload.latency, UserAgent: payload.userAgent, Log: *payload})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, spoolRecordHeaderSize, spoolRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("spool is closed")
+	}
+	if s.size+int64(len(record)) > s.maxSize {
+		return errSpoolFull
+	}
+
+	last := &s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+int64(len(record)) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = &s.segments[len(s.segments)-1]
+	}
+
+	n, err := s.writer.Write(record)
+	last.size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if s.syncPolicy == SpoolSyncAlways {
+		return s.writer.Sync()
+	}
+	s.dirty = true
+	return nil
+}
+
+// appendAll spools logs the retry policy gave up on, it's used as a DeadLetter callback
+func (s *diskSpool) appendAll(entries []AccessLog, err error) {
+	for i := range entries {
+		if err := s.append(&entries[i]); err != nil {
+			log.Printf("[ERROR][http-logging-middleware] Impossible to spool %d request log(s): %v", len(entries)-i, err)
+			return
+		}
+	}
+}
+
+// rotate closes the segment being written and starts a new one
+func (s *diskSpool) rotate() (err error) {
+	if err = s.writer.Sync(); err != nil {
+		return err
+	}
+	s.writer.Close()
+
+	seq := s.segments[len(s.segments)-1].seq + 1
+	if s.writer, err = os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+	s.segments = append(s.segments, spoolSegment{seq: seq})
+	return nil
+}
+
+// spooledLog is a log read from the spool, along with the position of the record following it
+type spooledLog struct {
+	payload *AccessLog
+	seq     uint64
+	end     int64
+}
+
+// read returns up to limit of the oldest logs in the spool, without consuming them: they're only
+// consumed once commit is called with their position. Logs are read from a single segment at a
+// time, an empty slice is returned when the spool is empty.
+func (s *diskSpool) read(limit int) (logs []spooledLog, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, nil
+	}
+
+	// Everything before the reader position has been consumed, segments we're done with can go
+	for {
+		first := s.segments[0]
+		if s.reader == nil {
+			if s.reader, err = os.Open(s.segmentPath(first.seq)); err != nil {
+				return nil, err
+			}
+		}
+		if s.readOffset < first.size {
+			if _, ok := s.readRecord(s.reader, s.readOffset, first.size, nil); ok {
+				break
+			}
+			log.Printf("[WARNING][http-logging-middleware] Corrupted record in spool segment %d, skipping the rest of it", first.seq)
+		}
+
+		// We're done with this segment, unless it's still being written to
+		if len(s.segments) == 1 {
+			s.readOffset = first.size
+			return nil, nil
+		}
+		s.reader.Close()
+		s.reader = nil
+		os.Remove(s.segmentPath(first.seq))
+		s.size -= first.size
+		s.segments = s.segments[1:]
+		s.readOffset = 0
+	}
+
+	first := s.segments[0]
+	for offset := s.readOffset; offset < first.size && len(logs) < limit; {
+		var record spoolRecord
+		recordSize, ok := s.readRecord(s.reader, offset, first.size, &record)
+		if !ok {
+			break
+		}
+		offset += recordSize
+		record.Log.startDate = record.StartDate
+		record.Log.latency = record.Latency
+		record.Log.userAgent = record.UserAgent
+		logs = append(logs, spooledLog{payload: &record.Log, seq: first.seq, end: offset})
+	}
+	return logs, nil
+}
+
+// commit consumes the logs returned by read, up to (and including) the one at the given position
+func (s *diskSpool) commit(seq uint64, end int64) {
+	s.mutex.Lock()
+	if !s.closed && s.segments[0].seq == seq && end > s.readOffset {
+		s.readOffset = end
+	}
+	s.mutex.Unlock()
+}
+
+// checkpoint persists the position of the reader, so that logs aren't replayed twice after a restart
+func (s *diskSpool) checkpoint() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmpPath := s.checkpointPath() + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "%d %d\n", s.segments[0].seq, s.readOffset); err == nil && s.syncPolicy != SpoolSyncNever {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.checkpointPath())
+}
+
+func (s *diskSpool) syncPeriodically() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.dirty {
+				if err := s.writer.Sync(); err != nil {
+					log.Println("[WARNING][http-logging-middleware] Failed to sync spool:", err)
+				}
+				s.dirty = false
+			}
+			s.mutex.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close persists the reader position and flushes the spool to disk
+func (s *diskSpool) close() error {
+	err := s.checkpoint()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return err
+	}
+	s.closed = true
+	close(s.stop)
+
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	if syncErr := s.writer.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := s.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package ginhttplogger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that spooled logs survive a restart, that replayed logs aren't replayed twice and that torn
+// records are discarded
+func TestDiskSpoolReplay(t *testing.T) {
+	conf := AccessLoggerConfig{
+		SpoolDir:          t.TempDir(),
+		SpoolMaxSize:      1 << 20,
+		SpoolSync:         SpoolSyncAlways,
+		SpoolSyncInterval: time.Second,
+	}
+	startDate := time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	spool, err := openDiskSpool(conf)
+	assert.NoError(t, err)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		assert.NoError(t, spool.append(&AccessLog{Request: RequestLogEntry{Path: path}, startDate: startDate}))
+	}
+
+	// Logs are only consumed once committed
+	logs, err := spool.read(10)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 3)
+	logs, err = spool.read(1)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "/a", logs[0].payload.Request.Path)
+		assert.Equal(t, startDate, logs[0].payload.startDate.UTC())
+		spool.commit(logs[0].seq, logs[0].end)
+	}
+	assert.NoError(t, spool.close())
+
+	// Let's simulate a crash in the middle of a write
+	segment, err := os.OpenFile(filepath.Join(conf.SpoolDir, "00000000000000000001.seg"), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	segment.Write([]byte{0, 0, 1, 0, 42})
+	segment.Close()
+
+	spool, err = openDiskSpool(conf)
+	assert.NoError(t, err)
+	assert.NoError(t, spool.append(&AccessLog{Request: RequestLogEntry{Path: "/d"}}))
+
+	var paths []string
+	for {
+		logs, err := spool.read(1)
+		assert.NoError(t, err)
+		if len(logs) == 0 {
+			break
+		}
+		paths = append(paths, logs[0].payload.Request.Path)
+		spool.commit(logs[0].seq, logs[0].end)
+	}
+	assert.Equal(t, []string{"/b", "/c", "/d"}, paths)
+	assert.NoError(t, spool.close())
+}
+
+// Test that the length of a corrupted record is checked before anything gets allocated
+func TestDiskSpoolCorruptedLength(t *testing.T) {
+	conf := AccessLoggerConfig{SpoolDir: t.TempDir(), SpoolMaxSize: 1 << 20, SpoolSync: SpoolSyncNever}
+	spool, err := openDiskSpool(conf)
+	assert.NoError(t, err)
+	assert.NoError(t, spool.append(&AccessLog{Request: RequestLogEntry{Path: "/a"}}))
+	assert.NoError(t, spool.close())
+
+	segment, err := os.OpenFile(filepath.Join(conf.SpoolDir, "00000000000000000001.seg"), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	segment.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 42})
+	segment.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	spool, err = openDiskSpool(conf)
+	assert.NoError(t, err)
+	defer spool.close()
+	logs, err := spool.read(10)
+	runtime.ReadMemStats(&after)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "/a", logs[0].payload.Request.Path)
+	}
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+// Test that the spool refuses logs once it reached its maximum size
+func TestDiskSpoolMaxSize(t *testing.T) {
+	spool, err := openDiskSpool(AccessLoggerConfig{SpoolDir: t.TempDir(), SpoolMaxSize: 1000, SpoolSync: SpoolSyncNever})
+	assert.NoError(t, err)
+	defer spool.close()
+
+	for err == nil {
+		err = spool.append(&AccessLog{Request: RequestLogEntry{Path: "/spooled"}})
+	}
+	assert.Equal(t, errSpoolFull, err)
+	assert.True(t, spool.size <= 1000)
+}
+
+// manualLogForwardingQueue hands the logs it receives to the test, which tells when they're handled
+type manualLogForwardingQueue struct {
+	Intake   chan Log
+	release  chan struct{}
+	received chan Log
+}
+
+func (q *manualLogForwardingQueue) intake() chan Log {
+	return q.Intake
+}
+
+func (q *manualLogForwardingQueue) run() {
+	<-q.release
+	for logEntry := range q.Intake {
+		q.received <- logEntry
+	}
+}
+
+// Test that logs that don't fit in the queue are spooled, and only consumed from the spool once the
+// forwarder is done with them
+func TestAccessLoggerSpoolReplay(t *testing.T) {
+	spool, err := openDiskSpool(AccessLoggerConfig{SpoolDir: t.TempDir(), SpoolMaxSize: 1 << 20, SpoolSync: SpoolSyncNever})
+	assert.NoError(t, err)
+	queue := &manualLogForwardingQueue{Intake: make(chan Log, 2), release: make(chan struct{}), received: make(chan Log, 10)}
+	metrics := NewExpvarMetrics("")
+	accessLogger := newAccessLogger(AccessLoggerConfig{DropSize: 2, Metrics: metrics}, queue)
+	accessLogger.spool = spool
+	accessLogger.start()
+
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		accessLogger.enqueue(Log{payload: &AccessLog{Request: RequestLogEntry{Path: path}}})
+	}
+	spooled := func() (paths []string) {
+		logs, err := spool.read(10)
+		assert.NoError(t, err)
+		for _, spooled := range logs {
+			paths = append(paths, spooled.payload.Request.Path)
+		}
+		return paths
+	}
+	assert.Eventually(t, func() bool { return len(spooled()) == 2 }, time.Second, 10*time.Millisecond)
+
+	close(queue.release)
+	receive := func() Log {
+		select {
+		case logEntry := <-queue.received:
+			return logEntry
+		case <-time.After(3 * spoolReplayInterval):
+			t.Fatal("no log received")
+			return Log{}
+		}
+	}
+	for _, path := range []string{"/a", "/b"} {
+		assert.Equal(t, path, buildPayload(&[]Log{receive()}[0]).Request.Path)
+	}
+
+	// Replayed logs stay in the spool until they're handled
+	replayed := receive()
+	assert.Equal(t, "/c", replayed.payload.Request.Path)
+	assert.Equal(t, []string{"/c", "/d"}, spooled())
+	logsHandled([]Log{replayed})
+	assert.Equal(t, []string{"/d"}, spooled())
+
+	replayed = receive()
+	assert.Equal(t, "/d", replayed.payload.Request.Path)
+	logsHandled([]Log{replayed})
+	assert.Empty(t, spooled())
+	assert.NoError(t, accessLogger.Shutdown(context.Background()))
+
+	// Replayed logs are counted as they're queued
+	assert.Equal(t, "4", metrics.Vars().Get("enqueued").String())
+}
+
+// Test that the spool is only closed once the forwarder returned, even when Shutdown gives up
+// waiting for it, since it may still spool logs through the dead letter callback
+func TestAccessLoggerSpoolShutdown(t *testing.T) {
+	spool, err := openDiskSpool(AccessLoggerConfig{SpoolDir: t.TempDir(), SpoolMaxSize: 1 << 20, SpoolSync: SpoolSyncNever})
+	assert.NoError(t, err)
+	queue := &stalledLogForwardingQueue{Intake: make(chan Log, 1), release: make(chan struct{})}
+	accessLogger := newAccessLogger(AccessLoggerConfig{DropSize: 1}, queue)
+	accessLogger.spool = spool
+	accessLogger.start()
+	accessLogger.enqueue(Log{payload: &AccessLog{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, accessLogger.Shutdown(ctx))
+
+	closed := func() bool {
+		spool.mutex.Lock()
+		defer spool.mutex.Unlock()
+		return spool.closed
+	}
+	assert.False(t, closed())
+	assert.NoError(t, spool.append(&AccessLog{}))
+
+	close(queue.release)
+	assert.Eventually(t, closed, time.Second, 10*time.Millisecond)
+}
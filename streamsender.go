@@ -0,0 +1,75 @@
+package ginhttplogger
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// streamSender holds the connection of the forwarders that write logs on a socket (Fluentd, syslog,
+// GELF), which is opened when needed and reopened whenever a write fails
+type streamSender struct {
+	name    string // of the forwarder, in our log messages
+	backend string
+	timeout time.Duration
+	dial    func() (net.Conn, error)
+	retry   retryPolicy
+
+	conn    net.Conn
+	written int // bytes written during the current batch
+}
+
+func newStreamSender(name, backend string, timeout time.Duration, dial func() (net.Conn, error), conf AccessLoggerConfig) streamSender {
+	return streamSender{
+		name:    name,
+		backend: backend,
+		timeout: timeout,
+		dial:    dial,
+		retry:   newRetryPolicy(conf),
+	}
+}
+
+// deliver sends the messages of a batch of logs with send, which returns how many of them were
+// sent, reconnecting and retrying until they've all been sent or the retry policy gives up on them
+func deliver[T any](s *streamSender, payloads []AccessLog, messages []T, send func([]T) (int, error)) {
+	start := time.Now()
+	total := len(messages)
+	s.written = 0
+	err := s.retry.run(func() (err error) {
+		sent := 0
+		if s.conn == nil {
+			s.conn, err = s.dial()
+		}
+		if err == nil {
+			// Messages that made it through on a previous attempt aren't sent again
+			sent, err = send(messages)
+		}
+		messages, payloads = messages[sent:], payloads[sent:]
+		if err != nil {
+			log.Printf("[WARNING][%s-middleware] Impossible to send %d request log(s) to %s: %v", s.name, len(messages), s.backend, err)
+			s.disconnect()
+		}
+		return err
+	})
+	if delivered := total - len(messages); delivered > 0 {
+		s.retry.metrics.Forwarded(delivered, s.written, time.Since(start))
+	}
+	if err != nil {
+		s.retry.discard(payloads, err)
+	}
+}
+
+// write writes data on the connection, within the timeout
+func (s *streamSender) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	n, err := s.conn.Write(data)
+	s.written += n
+	return err
+}
+
+func (s *streamSender) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,117 @@
+package ginhttplogger
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Keys under which the request ID and trace context are stored on the gin.Context, handlers can
+// read them with c.GetString() (or with ContextValue() behind the net/http middleware)
+const (
+	ContextKeyRequestID    = "ginhttplogger.request_id"
+	ContextKeyTraceID      = "ginhttplogger.trace_id"
+	ContextKeyParentSpanID = "ginhttplogger.parent_span_id"
+	ContextKeyTraceState   = "ginhttplogger.trace_state"
+)
+
+// maxRequestIDLength bounds the size of request IDs we accept from clients
+const maxRequestIDLength = 128
+
+// traceContext holds the trace identifiers propagated in the request headers. We don't create spans,
+// the span ID we're given is the one of the caller: the parent of the span of the request.
+type traceContext struct {
+	traceID      string
+	parentSpanID string
+	traceState   string
+}
+
+// GetRequestID returns the ID of the request being handled
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(ContextKeyRequestID)
+}
+
+// requestIDFromHeader returns the request ID sent by the client, or a new one if it didn't send any (or if
+// it's not something we'd like to see in our logs)
+func requestIDFromHeader(header http.Header, name string) string {
+	if id := header.Get(name); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	return newUUID()
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// parseTraceContext reads W3C Trace Context (https://www.w3.org/TR/trace-context/) headers, falling
+// back to B3 (https://github.com/openzipkin/b3-propagation), single and multiple headers flavours
+func parseTraceContext(header http.Header) (tc traceContext) {
+	if traceparent := header.Get("Traceparent"); traceparent != "" {
+		// version-traceid-parentid-flags, future versions may append fields
+		fields := strings.Split(strings.TrimSpace(traceparent), "-")
+		if len(fields) >= 4 && isHex(fields[0], 2) && fields[0] != "ff" && (fields[0] != "00" || len(fields) == 4) &&
+			isHex(fields[1], 32) && !isZero(fields[1]) && isHex(fields[2], 16) && !isZero(fields[2]) && isHex(fields[3], 2) {
+			tc.traceID = fields[1]
+			tc.parentSpanID = fields[2]
+			tc.traceState = header.Get("Tracestate")
+			return tc
+		}
+	}
+
+	if b3 := header.Get("B3"); b3 != "" {
+		// traceid-spanid[-sampled[-parentspanid]], or only the sampling decision
+		fields := strings.Split(strings.ToLower(strings.TrimSpace(b3)), "-")
+		if len(fields) >= 2 && isB3TraceID(fields[0]) && isHex(fields[1], 16) {
+			tc.traceID = fields[0]
+			tc.parentSpanID = fields[1]
+			return tc
+		}
+	}
+
+	traceID := strings.ToLower(header.Get("X-B3-Traceid"))
+	spanID := strings.ToLower(header.Get("X-B3-Spanid"))
+	if isB3TraceID(traceID) && isHex(spanID, 16) {
+		tc.traceID = traceID
+		tc.parentSpanID = spanID
+	}
+	return tc
+}
+
+func isB3TraceID(s string) bool {
+	return (isHex(s, 16) || isHex(s, 32)) && !isZero(s)
+}
+
+// isHex returns true if s is made of length lowercase hexadecimal digits
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+func isPrintableASCII(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package ginhttplogger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceContext(t *testing.T) {
+	for headers, expected := range map[[2]string]traceContext{
+		{"Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}: {traceID: "4bf92f3577b34da6a3ce929d0e0e4736", parentSpanID: "00f067aa0ba902b7"},
+		{"Traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"}: {},
+		{"Traceparent", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"}: {},
+		{"B3", "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"}:              {traceID: "80f198ee56343ba864fe8b2a57d3eff7", parentSpanID: "e457b5a2e4d86bd1"},
+		{"B3", "1"}:                          {},
+		{"X-B3-TraceId", "463ac35c9f6413ad"}: {},
+	} {
+		header := http.Header{}
+		header.Set(headers[0], headers[1])
+		assert.Equal(t, expected, parseTraceContext(header), headers[1])
+	}
+
+	header := http.Header{}
+	header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	assert.Equal(t, traceContext{traceID: "463ac35c9f6413ad", parentSpanID: "a2fb4a1d1a96d312"}, parseTraceContext(header))
+}
+
+// Test that request IDs are propagated or generated, exposed to handlers and logged
+func TestMiddlewareRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	conf := AccessLoggerConfig{DropSize: 10, RequestIDHeader: "X-Request-ID"}
+	logQueue := NewMockedLogForwardingQueue(conf)
+	router.Use(buildLoggingMiddleware(conf, newAccessLogger(conf, logQueue)))
+	go logQueue.run()
+
+	var handlerRequestID, handlerTraceID string
+	router.GET("/ping", func(c *gin.Context) {
+		handlerRequestID = GetRequestID(c)
+		handlerTraceID = c.GetString(ContextKeyTraceID)
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/ping", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "req-42", handlerRequestID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerTraceID)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+
+	logEntry := logQueue.pop()
+	payload := buildPayload(&logEntry)
+	assert.Equal(t, "req-42", payload.RequestID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", payload.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", payload.ParentSpanID)
+
+	// Without a request ID, one should be generated
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", requestIDFromHeader(http.Header{}, "X-Request-ID"))
+}
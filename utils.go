@@ -1,8 +1,15 @@
 package ginhttplogger
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func min(a, b int64) int64 {
@@ -19,8 +26,75 @@ func max(a, b int) int {
 	return b
 }
 
-// Compute the size of request headers and flatten the header values
-func normalizeHeaderMap(headerMap http.Header) (normalizedHeaderMap map[string]string, headerMapSize int) {
+// statusLevel returns the level of the log of a request, following its response status: errors for
+// 5xx, warnings for 4xx, info otherwise
+func statusLevel(status int) logrus.Level {
+	if status >= 500 {
+		return logrus.ErrorLevel
+	} else if status >= 400 {
+		return logrus.WarnLevel
+	}
+	return logrus.InfoLevel
+}
+
+// backendURL returns the base URL of HTTP-based backends: URL when it's set, http://Host:Port
+// otherwise
+func backendURL(conf AccessLoggerConfig) string {
+	if conf.URL != "" {
+		return conf.URL
+	}
+	return fmt.Sprintf("http://%s:%d", conf.Host, conf.Port)
+}
+
+// backendTimeout bounds requests to HTTP-based backends, reading their response included
+const backendTimeout = 30 * time.Second
+
+// backendClient sends requests to HTTP-based backends
+var backendClient = &http.Client{Timeout: backendTimeout}
+
+// postToBackend sends a body to an HTTP-based backend, anything but a 2xx response is considered a
+// failure
+func postToBackend(url, contentType string, body []byte) error {
+	resp, err := backendClient.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := backendResponseError(resp); err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// backendResponseError returns the error a non-2xx response from an HTTP-based backend stands for.
+// 4xx responses other than 429 are permanent failures, the error then holds the beginning of the
+// response body, which usually explains what's wrong with the request.
+func backendResponseError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		if reason := strings.TrimSpace(string(reason)); reason != "" {
+			return permanent(fmt.Errorf("request rejected: %s: %s", resp.Status, reason))
+		}
+		return permanent(fmt.Errorf("request rejected: %s", resp.Status))
+	}
+	return fmt.Errorf("unexpected response status: %s", resp.Status)
+}
+
+func truncate(b []byte, size int64) []byte {
+	if int64(len(b)) > size {
+		return b[:size]
+	}
+	return b
+}
+
+// Compute the size of request headers and flatten the header values, header policies are applied to
+// the flattened values but the size is the one of the original headers
+func normalizeHeaderMap(headerMap http.Header, formatting *formattingOptions) (normalizedHeaderMap map[string]string, headerMapSize int) {
 	headerMapSize = 0
 	normalizedHeaderMap = make(map[string]string)
 	for name, value := range headerMap {
@@ -28,46 +102,177 @@ func normalizeHeaderMap(headerMap http.Header) (normalizedHeaderMap map[string]s
 		for _, v := range value {
 			headerMapSize += len(v)
 		}
-		normalizedHeaderMap[strings.ToLower(strings.Replace(name, "-", "_", -1))] = strings.Join(value, ", ")
+		if flattened, ok := formatting.redactHeader(name, strings.Join(value, ", ")); ok {
+			normalizedHeaderMap[strings.ToLower(strings.Replace(name, "-", "_", -1))] = flattened
+		}
 	}
 	return
 }
 
+// Masks the values of redacted query parameters in the raw query, preserving its ordering and
+// encoding, and flattens the parsed parameter values
+func normalizeQuery(rawQuery string, redacted map[string]struct{}) (query string, params map[string]string) {
+	if rawQuery == "" {
+		return "", nil
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	values := make(map[string][]string)
+	for i, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+
+		rawName, rawValue := pair, ""
+		if j := strings.IndexByte(pair, '='); j >= 0 {
+			rawName, rawValue = pair[:j], pair[j+1:]
+		}
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			value = rawValue
+		}
+
+		if _, ok := redacted[strings.ToLower(name)]; ok {
+			value = redactedValue
+			pairs[i] = rawName + "=" + url.QueryEscape(redactedValue)
+		}
+		values[name] = append(values[name], value)
+	}
+
+	params = make(map[string]string, len(values))
+	for name, value := range values {
+		params[name] = strings.Join(value, ", ")
+	}
+	return strings.Join(pairs, "&"), params
+}
+
 // Formats a given payload as
 func buildPayload(logEntry *Log) (logPayload AccessLog) {
+	// Logs replayed from the spool have already been formatted
+	if logEntry.payload != nil {
+		return *logEntry.payload
+	}
+
 	// Let's normalize our headers to match Kong's format as well as our Django logger's
-	requestHeaders, requestHeaderSize := normalizeHeaderMap(logEntry.context.Request.Header)
-	responseHeaders, responseHeaderSize := normalizeHeaderMap(logEntry.responseHeaders)
+	requestHeaders, requestHeaderSize := normalizeHeaderMap(logEntry.request.Header, logEntry.formatting)
+	responseHeaders, responseHeaderSize := normalizeHeaderMap(logEntry.responseHeaders, logEntry.formatting)
+	endDate := logEntry.startDate.Add(logEntry.latency)
+	startMillis, startNanos := logEntry.formatting.epochTimes(logEntry.startDate)
+	endMillis, endNanos := logEntry.formatting.epochTimes(endDate)
+	query, queryParams := normalizeQuery(logEntry.request.URL.RawQuery, logEntry.formatting.redactedQueryParams)
+
+	// Bodies may be compressed or binary, let's decode and encode them accordingly
+	requestContent := logEntry.formatting.httpContent(logEntry.requestBody, logEntry.requestBodyTail, logEntry.requestBodyOmitted, requestContentType(logEntry.request), logEntry.request.Header.Get("Content-Encoding"), logEntry.bodyLogSize)
+	requestContent.Size = logEntry.requestContentLength
+	requestContent.MimeType = requestContentType(logEntry.request)
+
+	responseContent := logEntry.formatting.httpContent(logEntry.responseBody, logEntry.responseBodyTail, logEntry.responseBodyOmitted, logEntry.responseHeaders.Get("Content-Type"), logEntry.responseHeaders.Get("Content-Encoding"), logEntry.bodyLogSize)
+	responseContent.Size = logEntry.responseContentLength
+	responseContent.MimeType = logEntry.responseHeaders.Get("Content-Type")
 
 	// Let's parse the request and response objects and put that in a JSON-friendly map
 	logPayload = AccessLog{
-		TimeStarted:   logEntry.startDate.Format("2006-01-02T15:04:05.999+0100"),
-		ClientAddress: logEntry.context.ClientIP(),
-		Time:          int64(logEntry.latency.Nanoseconds() / 1000),
+		TimeStarted:   logEntry.formatting.formatTime(logEntry.startDate),
+		TimeEnded:     logEntry.formatting.formatTime(endDate),
+		StartMillis:   startMillis,
+		EndMillis:     endMillis,
+		StartNanos:    startNanos,
+		EndNanos:      endNanos,
+		ClientAddress: logEntry.clientIP,
+		RequestID:     logEntry.requestID,
+		TraceID:       logEntry.trace.traceID,
+		ParentSpanID:  logEntry.trace.parentSpanID,
+		SampledOut:    logEntry.sampledOut,
+		Time:          int64(logEntry.latency / logEntry.formatting.durationUnit),
+		TimeUnit:      logEntry.formatting.durationName,
 		Request: RequestLogEntry{
-			Method:      logEntry.context.Request.Method,
-			Path:        logEntry.context.Request.URL.Path,
-			HTTPVersion: logEntry.context.Request.Proto,
+			Method:      logEntry.request.Method,
+			Path:        logEntry.request.URL.Path,
+			Route:       logEntry.route,
+			Query:       query,
+			QueryParams: queryParams,
+			HTTPVersion: logEntry.request.Proto,
 			Headers:     requestHeaders,
 			HeaderSize:  requestHeaderSize,
-			Content: HTTPContent{
-				Size:     logEntry.context.Request.ContentLength,
-				MimeType: logEntry.context.ContentType(),
-				Content:  logEntry.requestBody,
-			},
+			Content:     requestContent,
 		},
-		Errors: logEntry.context.Errors.String(),
+		Errors: logEntry.errors,
 		Response: ResponseLogEntry{
-			Status:     logEntry.context.Writer.Status(),
+			Status:     logEntry.status,
 			Headers:    responseHeaders,
 			HeaderSize: int(responseHeaderSize),
-			Content: HTTPContent{
-				Size:     logEntry.responseContentLength,
-				MimeType: responseHeaders["content_type"],
-				Content:  logEntry.responseBody,
-			},
+			Content:    responseContent,
 		},
 	}
 
+	logPayload.startDate = logEntry.startDate
+	logPayload.latency = logEntry.latency
+	logPayload.userAgent = logEntry.request.UserAgent()
+
 	return logPayload
 }
+
+// Reads logs from intake and hands them to send by batches of at most maxSize entries. Incomplete
+// batches are sent anyway every interval so that logs don't linger in memory on quiet servers, when
+// a flush is requested and when intake gets closed.
+func batchLogs(intake chan Log, maxSize int, interval time.Duration, send func([]Log)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]Log, 0, maxSize)
+	flush := func() {
+		if len(batch) > 0 {
+			send(batch)
+			logsHandled(batch)
+			batch = make([]Log, 0, maxSize)
+		}
+	}
+
+	for {
+		select {
+		case logEntry, ok := <-intake:
+			if !ok {
+				flush()
+				return
+			}
+			if logEntry.flushed != nil {
+				flush()
+				close(logEntry.flushed)
+				continue
+			}
+			batch = append(batch, logEntry)
+			if len(batch) >= maxSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// logsHandled tells the disk spool that forwarders are done with the logs it replayed
+func logsHandled(logs []Log) {
+	for i := range logs {
+		if logs[i].handled != nil {
+			logs[i].handled()
+		}
+	}
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}